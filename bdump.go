@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+)
+
+// bdump pretty-prints a bencoded document -- a .torrent file, a tracker
+// response, an extension message -- as JSON.
+func bdump(args []string) error {
+	flags := flag.NewFlagSet("bdump", flag.ExitOnError)
+	binary := flags.String("binary", "hex", "how to render binary strings: hex or base64")
+	roundTrip := flags.Bool("roundtrip", false, "mark binary strings so the output can be converted back (implies -full)")
+	full := flags.Bool("full", false, "print the pieces blob in full rather than summarising it")
+	skip := flags.Int("skip", 0, "skip this many bytes of header before the bencoded data, e.g. for extension messages")
+	flags.Parse(args)
+
+	opts := bencoding.JSONOptions{Indent: "  ", RoundTrip: *roundTrip}
+	switch *binary {
+	case "hex":
+		opts.Binary = bencoding.Hex
+	case "base64":
+		opts.Binary = bencoding.Base64
+	default:
+		return fmt.Errorf("unknown binary encoding %q", *binary)
+	}
+
+	var data []byte
+	var err error
+	switch flags.NArg() {
+	case 0:
+		data, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		data, err = ioutil.ReadFile(flags.Arg(0))
+	default:
+		return fmt.Errorf("expected at most one file, got %v", flags.NArg())
+	}
+	if err != nil {
+		return err
+	}
+	if *skip > len(data) {
+		return fmt.Errorf("can't skip %v bytes of %v", *skip, len(data))
+	}
+	data = data[*skip:]
+
+	// Some messages (e.g. ut_metadata pieces) carry raw data after the
+	// bencoded part, so dump what we can and report the rest.
+	var trailing []byte
+	decodeOpts := bencoding.DecodeOptions{UseBigInt: true}
+	v, err := decodeOpts.Decode(data)
+	var serr *bencoding.SyntaxError
+	if errors.As(err, &serr) && serr.Rule == bencoding.RuleTrailingData {
+		trailing = data[serr.Offset:]
+		v, err = decodeOpts.Decode(data[:serr.Offset])
+	}
+	if err != nil {
+		return err
+	}
+
+	if !*full && !*roundTrip {
+		summarisePieces(v)
+	}
+
+	out, err := bencoding.ToJSON(v, &opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	if len(trailing) > 0 {
+		fmt.Fprintf(os.Stderr, "%v bytes of trailing data after bencoded value\n", len(trailing))
+	}
+	return nil
+}
+
+// summarisePieces replaces any "pieces" blob of SHA-1 hashes in v with a short
+// description, as it's usually far longer than everything else put together.
+func summarisePieces(v interface{}) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, el := range v {
+			summarisePieces(el)
+		}
+	case map[string]interface{}:
+		for k, el := range v {
+			if pieces, ok := el.([]byte); ok && k == "pieces" && len(pieces)%20 == 0 {
+				v[k] = fmt.Sprintf("<%v pieces>", len(pieces)/20)
+				continue
+			}
+			summarisePieces(el)
+		}
+	}
+}
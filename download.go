@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/swarm"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+// peerID returns the peer id to use for tf. Private trackers expect us to
+// keep the same one between sessions, so for private torrents it's saved in
+// the user's config directory; otherwise a fresh one is used each time.
+func peerID(tf torrentfile.TorrentFile) (peer.ID, error) {
+	if !tf.Info.Private {
+		return peer.NewID()
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return peer.ID{}, err
+	}
+	return peer.LoadID(filepath.Join(dir, "femtotorrent", "peer-id"))
+}
+
+func download(args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	pickerName := flags.String("picker", "rarest", "piece picking strategy: rarest or sequential (priority picking is only available to library users, as swarm.Prioritized)")
+	lazyBitfield := flags.Bool("lazy-bitfield", false, "leave some pieces out of the bitfield sent to peers, sending have messages for them instead")
+	flags.Parse(args)
+	var picker swarm.PiecePicker
+	switch *pickerName {
+	case "rarest":
+		picker = swarm.NewRarestFirst()
+	case "sequential":
+		picker = swarm.Sequential{}
+	default:
+		return fmt.Errorf("unknown piece picker %q", *pickerName)
+	}
+
+	torrentPath := "debian-11.2.0-amd64-netinst.iso.torrent"
+	if flags.NArg() > 0 {
+		torrentPath = flags.Arg(0)
+	}
+	file, err := os.Open(torrentPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tf, err := torrentfile.ReadTorrentFile(file)
+	if err != nil {
+		return err
+	}
+	if tf.Info.Files != nil {
+		return fmt.Errorf("downloading multi-file torrents is not yet supported")
+	}
+
+	id, err := peerID(tf)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Writing to %v", tf.Info.Name)
+	f, err := os.OpenFile(tf.Info.Name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(tf.Info.TotalLength()); err != nil {
+		return err
+	}
+	s := swarm.New(tf, id, f)
+	s.Picker = picker
+	s.LazyBitfield = *lazyBitfield
+
+	listener, err := peer.Listen()
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.AddConn(conn)
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	log.Printf("Peer id %v, listening on port %v", id, port)
+	if tf.Info.Private {
+		log.Printf("Private torrent: only using peers from its trackers")
+	}
+
+	announcer, err := tracker.NewAnnouncer(tf, id, port, func() tracker.Stats {
+		return tracker.Stats{Downloaded: s.Downloaded(), Left: s.Left()}
+	})
+	if err != nil {
+		return err
+	}
+	s.Trackers = announcer.Manager()
+	ctx, cancel := context.WithCancel(context.Background())
+	announcerDone := make(chan error, 1)
+	go func() {
+		announcerDone <- announcer.Run(ctx, func(peers []peer.Peer) {
+			log.Printf("Tracker returned %v peers", len(peers))
+			s.AddPeers(peer.SourceTracker, peers)
+		})
+	}()
+	defer func() {
+		cancel()
+		if err := <-announcerDone; err != nil {
+			log.Printf("Final announce failed: %v", err)
+		}
+	}()
+
+	err = s.Run(ctx)
+	if err == nil {
+		log.Println("Download complete!")
+		if d := s.Duplicate(); d > 0 {
+			log.Printf("%v bytes were received more than once", d)
+		}
+		announcer.Completed()
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package bencoding
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func readDebianTorrent(tb testing.TB) []byte {
+	b, err := ioutil.ReadFile("../testdata/debian-11.2.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+type benchTorrent struct {
+	Announce     string   `bencode:"announce"`
+	Comment      string   `bencode:"comment"`
+	CreationDate int64    `bencode:"creation date"`
+	HTTPSeeds    []string `bencode:"httpseeds"`
+	Info         struct {
+		Length      int64  `bencode:"length"`
+		Name        string `bencode:"name"`
+		PieceLength int64  `bencode:"piece length"`
+		Pieces      []byte `bencode:"pieces"`
+	} `bencode:"info"`
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data := readDebianTorrent(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data := readDebianTorrent(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v benchTorrent
+		if err := Unmarshal(data, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalStrict(b *testing.B) {
+	data := readDebianTorrent(b)
+	opts := DecodeOptions{Strict: true}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v benchTorrent
+		if err := opts.Unmarshal(data, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	data := readDebianTorrent(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var v benchTorrent
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	var v benchTorrent
+	if err := Unmarshal(readDebianTorrent(b), &v); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnmarshalAllocations(t *testing.T) {
+	data := readDebianTorrent(t)
+	var v benchTorrent
+	allocs := testing.AllocsPerRun(100, func() {
+		v = benchTorrent{}
+		if err := Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// One each for the three strings, two httpseeds and the slice holding
+	// them, plus a little slack. Notably nothing proportional to the size of
+	// the input.
+	if allocs > 10 {
+		t.Errorf("Unmarshal made %v allocations, want at most 10", allocs)
+	}
+
+	// The 30 KiB pieces blob should be a window onto the input, not a copy
+	start := bytes.Index(data, []byte("6:pieces30240:")) + len("6:pieces30240:")
+	if &v.Info.Pieces[0] != &data[start] {
+		t.Errorf("Unmarshal copied pieces rather than sharing memory with the input")
+	}
+}
@@ -20,160 +20,20 @@
 // and appear in sorted order (sorted as raw strings, not alphanumerics).
 package bencoding
 
-import (
-	"bytes"
-	"fmt"
-	"reflect"
-	"sort"
-	"strconv"
-)
-
-func decodeFirstToken(b []byte) ([]byte, interface{}, error) {
-	var err error
-	switch b[0] {
-	case 'l': // list
-		b = b[1:] // slurp up the 'l'
-		var ret []interface{}
-		for b[0] != 'e' {
-			var new interface{}
-			b, new, err = decodeFirstToken(b)
-			if err != nil {
-				return nil, nil, err
-			}
-			ret = append(ret, new)
-		}
-		if b[0] != 'e' {
-			return nil, nil, fmt.Errorf("expected e at end of list, got %v", b[1])
-		}
-		return b[1:], ret, nil
-	case 'i': // int
-		b = b[1:] // slurp up the 'i'
-		len := 0
-		if b[0] == '-' {
-			len += 1
-		}
-		// "Be lenient in what you accept" -- this does allow for leading zeroes
-		// which the spec says should not be permissible. TODO: strict mode?
-		if bytes.IndexByte([]byte("1234567890"), b[len]) < 0 { // We need at least one byte
-			return nil, nil, fmt.Errorf("invalid digit %v", b[len])
-		}
-		for bytes.IndexByte([]byte("1234567890"), b[len]) >= 0 {
-			len += 1
-		}
-		if b[len] != 'e' {
-			return nil, nil, fmt.Errorf("expected e at end of int, got %v", b[len])
-		}
-		i, err := strconv.Atoi(string(b[:len]))
-		return b[len+1:], i, err
-	case 'd': // dict
-		b = b[1:] // slurp up the 'd'
-		ret := make(map[string]interface{})
-		for b[0] != 'e' {
-			var key, val interface{}
-			b, key, err = decodeFirstToken(b)
-			if err != nil {
-				return nil, nil, err
-			}
-			b, val, err = decodeFirstToken(b)
-			if err != nil {
-				return nil, nil, err
-			}
-			// We can't use []byte as a key because slices are unhashable, and
-			// map keys must be hashable. We could mayyyybe conditionally
-			// convert only byte slices to strings, or something, but that
-			// really muddies up the code. The spec isn't very clear on whether
-			// or not dict keys have to be strings, but in practice it seems
-			// that they always are, so this (usually) works fine. This _would_
-			// cause problems if a key wasn't a valid UTF-8 string, but again,
-			// that doesn't seem to be common (as the keys are usually human-
-			// readable anyway).
-			keyArr, ok := key.([]byte)
-			if !ok {
-				return nil, nil, fmt.Errorf("expected string key, got %T (%v)", key, key)
-			}
-			ret[string(keyArr)] = val
-		}
-		if b[0] != 'e' {
-			return nil, nil, fmt.Errorf("expected e at end of list, got %v", b[1])
-		}
-		return b[1:], ret, nil
-	case '1', '2', '3', '4', '5', '6', '7', '8', '9': // string (starting with length)
-		lenLen := 0
-		for bytes.IndexByte([]byte("1234567890"), b[lenLen]) >= 0 {
-			lenLen += 1
-		}
-		len, err := strconv.Atoi(string(b[:lenLen]))
-		if err != nil {
-			return nil, nil, err
-		}
-		b = b[lenLen:]
-		if b[0] != ':' {
-			return nil, nil, fmt.Errorf("expecting ':', got %v", b)
-		}
-		b = b[1:]
-		return b[len:], b[:len], nil
-	}
-	return nil, nil, nil
-}
-
+// Decode decodes a single bencoded value into its generic form: integers
+// become int64, strings []byte (sharing memory with b), lists []interface{} and
+// dictionaries map[string]interface{}. Integers that don't fit in an int64
+// are an error unless DecodeOptions.UseBigInt is set.
 func Decode(b []byte) (interface{}, error) {
-	remainder, result, err := decodeFirstToken(b)
-	if err != nil {
+	var result interface{}
+	if err := Unmarshal(b, &result); err != nil {
 		return nil, err
-	} else if len(remainder) != 0 {
-		return nil, fmt.Errorf("leftover garbage: %q", remainder)
 	}
 	return result, nil
 }
 
+// Encode returns the bencoding of i. It accepts the generic form returned by
+// Decode, as well as anything else Marshal does.
 func Encode(i interface{}) ([]byte, error) {
-	switch reflect.TypeOf(i).Kind() {
-	case reflect.Int:
-		return []byte(fmt.Sprintf("i%ve", i.(int))), nil
-	case reflect.Slice:
-		if reflect.TypeOf(i).Elem().Kind() == reflect.Uint8 { // string
-			return []byte(fmt.Sprintf("%v:%s", len(i.([]byte)), i.([]byte))), nil
-		}
-		var b bytes.Buffer
-		b.Write([]byte("l"))
-		for _, el := range i.([]interface{}) {
-			val, err := Encode(el)
-			if err != nil {
-				return nil, err
-			}
-			b.Write(val)
-		}
-		b.Write([]byte("e"))
-		return b.Bytes(), nil
-	case reflect.Map:
-		m := i.(map[string]interface{})
-
-		var keys []string
-		for key := range m {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
-
-		var b bytes.Buffer
-		b.Write([]byte("d"))
-		for _, key := range keys {
-			val, err := Encode(key)
-			if err != nil {
-				return nil, err
-			}
-			b.Write(val)
-			val, err = Encode(m[key])
-			if err != nil {
-				return nil, err
-			}
-			b.Write(val)
-		}
-		b.Write([]byte("e"))
-		return b.Bytes(), nil
-	case reflect.String:
-		return []byte(fmt.Sprintf("%v:%v", len(i.(string)), i.(string))), nil
-	default:
-
-		return nil, fmt.Errorf("Unknown kind %v (%v)", reflect.TypeOf(i).Kind(), i)
-	}
+	return Marshal(i)
 }
@@ -10,7 +10,7 @@ import (
 func TestDecodeNum(t *testing.T) {
 	cases := []struct {
 		in   []byte
-		want int
+		want int64
 	}{
 		{[]byte("i0e"), 0},
 		{[]byte("i1e"), 1},
@@ -24,9 +24,9 @@ func TestDecodeNum(t *testing.T) {
 			t.Fatalf("Decode returned error %v", err)
 		}
 
-		i, ok := got.(int)
+		i, ok := got.(int64)
 		if !ok {
-			t.Errorf("Decode did not return int, returned %T: %v", got, got)
+			t.Errorf("Decode did not return int64, returned %T: %v", got, got)
 			return
 		}
 		if i != c.want {
@@ -40,10 +40,10 @@ func TestDecodeNumArr(t *testing.T) {
 		in   []byte
 		want []interface{}
 	}{
-		{[]byte("li1ee"), []interface{}{1}},
-		{[]byte("li0ee"), []interface{}{0}},
-		{[]byte("li2ei3ee"), []interface{}{2, 3}},
-		{[]byte("li-2ei-3ee"), []interface{}{-2, -3}},
+		{[]byte("li1ee"), []interface{}{int64(1)}},
+		{[]byte("li0ee"), []interface{}{int64(0)}},
+		{[]byte("li2ei3ee"), []interface{}{int64(2), int64(3)}},
+		{[]byte("li-2ei-3ee"), []interface{}{int64(-2), int64(-3)}},
 	}
 	for _, c := range cases {
 		got, err := Decode(c.in)
@@ -68,7 +68,7 @@ func TestDecodeDict(t *testing.T) {
 		in   []byte
 		want map[string]interface{}
 	}{
-		{[]byte("d3:onei1e3:twoi2e5:threei3ee"), map[string]interface{}{"one": 1, "two": 2, "three": 3}},
+		{[]byte("d3:onei1e3:twoi2e5:threei3ee"), map[string]interface{}{"one": int64(1), "two": int64(2), "three": int64(3)}},
 	}
 	for _, c := range cases {
 		got, err := Decode(c.in)
@@ -122,7 +122,7 @@ func TestDecodeString(t *testing.T) {
 	}{
 		{[]byte("3:abc"), []byte("abc")},
 		{[]byte("3:foo"), []byte("foo")},
-		// {[]byte("0:"), []byte("")}, // TODO: fix
+		{[]byte("0:"), []byte("")},
 		{[]byte("5:\x00\x00\x00\x00\x00"), []byte("\x00\x00\x00\x00\x00")},
 	}
 	for _, c := range cases {
@@ -0,0 +1,197 @@
+package bencoding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fuzzSeeds are added to every bencoding fuzz target, alongside the hostile
+// corpus of truncated and malformed documents in ../testdata/hostile.
+var fuzzSeeds = []string{
+	"i0e",
+	"i-1e",
+	"i18446744073709551616e",
+	"0:",
+	"3:abc",
+	"le",
+	"li1ei2ee",
+	"de",
+	"d3:cow3:moo4:spam4:eggse",
+	"d4:spaml1:a1:bee",
+}
+
+func addFuzzSeeds(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Add(readDebianTorrent(f))
+
+	hostile, err := filepath.Glob("../testdata/hostile/*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range hostile {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+}
+
+// FuzzDecode checks that Decode never panics, and that anything it accepts
+// can be encoded and decoded again to the same value.
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := Decode(data)
+		if err != nil {
+			var serr *SyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("Decode(%q) returned %T, want *SyntaxError", data, err)
+			}
+			return
+		}
+		encoded, err := Encode(v)
+		if err != nil {
+			t.Fatalf("Encode(Decode(%q)) returned error %v", data, err)
+		}
+		again, err := (&DecodeOptions{Strict: true}).Decode(encoded)
+		if err != nil {
+			t.Fatalf("Encode(Decode(%q)) == %q, which isn't canonical: %v", data, encoded, err)
+		}
+		if !reflect.DeepEqual(normalise(v), normalise(again)) {
+			t.Fatalf("Decode(Encode(Decode(%q))) == %#v, want %#v", data, again, v)
+		}
+	})
+}
+
+// normalise turns empty lists into nil ones, as Decode doesn't distinguish
+// them and reflect.DeepEqual does.
+func normalise(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return []interface{}(nil)
+		}
+		for i := range v {
+			v[i] = normalise(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = normalise(v[k])
+		}
+	}
+	return v
+}
+
+// FuzzStrictRoundTrip checks that anything strict decoding accepts encodes
+// back to exactly the same bytes, which is the whole point of strict mode.
+func FuzzStrictRoundTrip(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := (&DecodeOptions{Strict: true, UseBigInt: true}).Decode(data)
+		if err != nil {
+			return
+		}
+		encoded, err := Encode(v)
+		if err != nil {
+			t.Fatalf("Encode(Decode(%q)) returned error %v", data, err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("Encode(Decode(%q)) == %q", data, encoded)
+		}
+	})
+}
+
+// FuzzDecoder checks that the streaming Decoder never panics, and agrees with
+// Decode about what's valid.
+func FuzzDecoder(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want, wantErr := Decode(data)
+
+		dec := NewDecoder(bytes.NewReader(data))
+		var got interface{}
+		err := dec.Decode(&got)
+		if err == nil {
+			if _, tokErr := dec.Token(); tokErr != io.EOF {
+				err = errors.New("trailing data")
+			}
+		}
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("Decoder.Decode(%q) returned %v, but Decode returned %v", data, err, wantErr)
+		}
+		if err == nil && !reflect.DeepEqual(normalise(got), normalise(want)) {
+			t.Fatalf("Decoder.Decode(%q) == %#v, Decode returned %#v", data, got, want)
+		}
+
+		// Walking the tokens must end in an error or EOF, never a panic
+		dec = NewDecoder(bytes.NewReader(data))
+		for {
+			if _, err := dec.Token(); err != nil {
+				break
+			}
+		}
+	})
+}
+
+// FuzzUnmarshal checks that Unmarshal never panics when the input doesn't
+// match the shape of the destination.
+func FuzzUnmarshal(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v struct {
+			I   int8              `bencode:"i"`
+			U   uint              `bencode:"u"`
+			B   bool              `bencode:"b"`
+			S   string            `bencode:"s"`
+			A   [2]byte           `bencode:"a"`
+			L   []int             `bencode:"l"`
+			M   map[string]string `bencode:"m"`
+			P   *testInfo         `bencode:"p"`
+			R   RawMessage        `bencode:"r"`
+			Big *testTorrent      `bencode:"info"`
+		}
+		Unmarshal(data, &v)
+		var l [3]interface{}
+		Unmarshal(data, &l)
+	})
+}
+
+// FuzzJSON checks that any decodable value survives a trip through JSON.
+func FuzzJSON(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := (&DecodeOptions{UseBigInt: true}).Decode(data)
+		if err != nil {
+			return
+		}
+		want, err := Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, binary := range []BinaryEncoding{Hex, Base64} {
+			j, err := ToJSON(v, &JSONOptions{Binary: binary, RoundTrip: true})
+			if err != nil {
+				t.Fatalf("ToJSON(Decode(%q)) returned error %v", data, err)
+			}
+			back, err := FromJSON(j)
+			if err != nil {
+				t.Fatalf("FromJSON(%s) returned error %v", j, err)
+			}
+			got, err := Encode(back)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("JSON round trip of %q gave %q", want, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package bencoding
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+)
+
+// BinaryEncoding selects how strings that aren't valid UTF-8 are written as
+// JSON.
+type BinaryEncoding int
+
+const (
+	Hex BinaryEncoding = iota
+	Base64
+)
+
+// JSONOptions controls how ToJSON renders bencoded values.
+type JSONOptions struct {
+	// Binary is the encoding used for strings that aren't valid UTF-8, such
+	// as info hashes, piece hashes and compact peer lists.
+	Binary BinaryEncoding
+
+	// RoundTrip marks binary strings so FromJSON can restore them exactly:
+	// they are written as {"$hex": "..."} or {"$base64": "..."} rather than as
+	// bare JSON strings. Dictionary keys that start with '$' gain an extra '$'
+	// to keep them distinct, and keys that aren't valid UTF-8 are written as
+	// "$hex:..." (or "$base64:...").
+	RoundTrip bool
+
+	// Indent, if set, pretty-prints the output, indenting each level with
+	// Indent.
+	Indent string
+}
+
+func (o *JSONOptions) encodeBinary(b []byte) string {
+	if o.Binary == Base64 {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (o *JSONOptions) binaryMarker() string {
+	if o.Binary == Base64 {
+		return "$base64"
+	}
+	return "$hex"
+}
+
+// ToJSON converts v, a bencoded value in the generic form returned by Decode,
+// to JSON. Strings that are valid UTF-8 become JSON strings; others are
+// encoded as described by opts.
+func ToJSON(v interface{}, opts *JSONOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &JSONOptions{}
+	}
+	j, err := opts.toJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", opts.Indent)
+	if err := enc.Encode(j); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func (o *JSONOptions) toJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case *big.Int:
+		return json.Number(v.String()), nil
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v), nil
+		}
+		if o.RoundTrip {
+			return map[string]string{o.binaryMarker(): o.encodeBinary(v)}, nil
+		}
+		return o.encodeBinary(v), nil
+	case string: // not produced by Decode, but handy for callers annotating a tree
+		return v, nil
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, el := range v {
+			j, err := o.toJSONValue(el)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = j
+		}
+		return ret, nil
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, el := range v {
+			j, err := o.toJSONValue(el)
+			if err != nil {
+				return nil, err
+			}
+			if o.RoundTrip {
+				if !utf8.ValidString(k) {
+					k = o.binaryMarker() + ":" + o.encodeBinary([]byte(k))
+				} else if strings.HasPrefix(k, "$") {
+					k = "$" + k
+				}
+			}
+			ret[k] = j
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("bencoding: cannot convert %T to JSON", v)
+}
+
+// FromJSON converts JSON produced by ToJSON with RoundTrip set back into the
+// generic form returned by Decode, ready to be passed to Encode. JSON
+// numbers must be integers; booleans and null have no bencoded equivalent.
+func FromJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var j interface{}
+	if err := dec.Decode(&j); err != nil {
+		return nil, err
+	}
+	return fromJSONValue(j)
+}
+
+func decodeBinary(marker, s string) ([]byte, error) {
+	if marker == "$base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return hex.DecodeString(s)
+}
+
+func fromJSONValue(j interface{}) (interface{}, error) {
+	switch j := j.(type) {
+	case json.Number:
+		if i, err := j.Int64(); err == nil {
+			return i, nil
+		}
+		if i, ok := new(big.Int).SetString(j.String(), 10); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("bencoding: cannot convert non-integer %v from JSON", j)
+	case string:
+		return []byte(j), nil
+	case []interface{}:
+		ret := make([]interface{}, len(j))
+		for i, el := range j {
+			v, err := fromJSONValue(el)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = v
+		}
+		return ret, nil
+	case map[string]interface{}:
+		if len(j) == 1 {
+			for marker, el := range j {
+				if s, ok := el.(string); ok && (marker == "$hex" || marker == "$base64") {
+					return decodeBinary(marker, s)
+				}
+			}
+		}
+		ret := make(map[string]interface{}, len(j))
+		for k, el := range j {
+			v, err := fromJSONValue(el)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case strings.HasPrefix(k, "$$"):
+				k = k[1:]
+			case strings.HasPrefix(k, "$hex:"), strings.HasPrefix(k, "$base64:"):
+				i := strings.IndexByte(k, ':')
+				b, err := decodeBinary(k[:i], k[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				k = string(b)
+			}
+			ret[k] = v
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("bencoding: cannot convert JSON %T to bencoding", j)
+}
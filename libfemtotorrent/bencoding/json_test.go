@@ -0,0 +1,92 @@
+package bencoding
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	cases := []struct {
+		in   string
+		opts JSONOptions
+		want string
+	}{
+		{"i-3e", JSONOptions{}, `-3`},
+		{"i123456789012345678901234567890e", JSONOptions{}, `123456789012345678901234567890`},
+		{"4:spam", JSONOptions{}, `"spam"`},
+		{"2:\xff\x00", JSONOptions{}, `"ff00"`},
+		{"2:\xff\x00", JSONOptions{Binary: Base64}, `"/wA="`},
+		{"2:\xff\x00", JSONOptions{RoundTrip: true}, `{"$hex":"ff00"}`},
+		{"l4:spami1ee", JSONOptions{}, `["spam",1]`},
+		{"d3:cow3:moo4:spam4:eggse", JSONOptions{}, `{"cow":"moo","spam":"eggs"}`},
+		{"d4:$hex2:ffe", JSONOptions{RoundTrip: true}, `{"$$hex":"ff"}`},
+		{"d1:\xffi1ee", JSONOptions{RoundTrip: true, Binary: Base64}, `{"$base64:/w==":1}`},
+		{"d1:ai1ee", JSONOptions{Indent: "  "}, "{\n  \"a\": 1\n}"},
+	}
+	for _, c := range cases {
+		v, err := (&DecodeOptions{UseBigInt: true}).Decode([]byte(c.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ToJSON(v, &c.opts)
+		if err != nil {
+			t.Errorf("ToJSON(%q) returned error %v", c.in, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("ToJSON(%q, %+v) == %s, want %s", c.in, c.opts, got, c.want)
+		}
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	cases := []string{
+		`1.5`,
+		`true`,
+		`null`,
+		`{"$hex":"xyz"}`,
+		`[`,
+	}
+	for _, c := range cases {
+		if v, err := FromJSON([]byte(c)); err == nil {
+			t.Errorf("FromJSON(%s) == %#v, want error", c, v)
+		}
+	}
+}
+
+func TestRoundTripJSON(t *testing.T) {
+	debtorrent, err := ioutil.ReadFile("../testdata/debian-11.2.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := [][]byte{
+		[]byte("i123456789012345678901234567890e"),
+		[]byte("d4:$hex2:ff1:\xffl2:\xff\x000:ee"),
+		[]byte(`d5:$$abc1:"e`),
+		debtorrent,
+	}
+	for _, c := range cases {
+		v, err := (&DecodeOptions{UseBigInt: true}).Decode(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, binary := range []BinaryEncoding{Hex, Base64} {
+			j, err := ToJSON(v, &JSONOptions{Binary: binary, RoundTrip: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err := FromJSON(j)
+			if err != nil {
+				t.Fatalf("FromJSON(%s) returned error %v", j, err)
+			}
+			got, err := Encode(back)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c) {
+				t.Errorf("Encode(FromJSON(ToJSON(%.40q))) == %.40q", c, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package bencoding
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Marshaler is implemented by types that know how to encode themselves. The
+// returned bytes must be a single valid bencoded value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that know how to decode themselves.
+// UnmarshalBencode receives a single bencoded value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// An UnmarshalTypeError describes a bencoded value that couldn't be stored in
+// a Go value of the given type.
+type UnmarshalTypeError struct {
+	Value string       // description of the bencoded value, e.g. "list"
+	Type  reflect.Type // type of the Go value it could not be assigned to
+	Field string       // the dict key leading to the value, if any
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("bencoding: cannot unmarshal %v into field %q of type %v", e.Value, e.Field, e.Type)
+	}
+	return fmt.Sprintf("bencoding: cannot unmarshal %v into Go value of type %v", e.Value, e.Type)
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	bigIntType      = reflect.TypeOf(big.Int{})
+	rawMessageType  = reflect.TypeOf(RawMessage(nil))
+)
+
+// Marshal returns the bencoding of v.
+//
+// Marshal works much like encoding/json. Strings, byte slices and byte arrays
+// are encoded as bencoded strings; every integer kind, big.Int, and bool (as 0
+// or 1) are encoded as integers; other slices and arrays become lists; maps with
+// string keys and structs become dictionaries, with keys sorted as raw
+// strings as the spec requires. Pointers and interfaces encode the value they
+// point to. Types implementing Marshaler encode themselves.
+//
+// Struct fields are encoded using the field name unless a tag is given:
+//
+//	PieceLength int `bencode:"piece length"`      // key "piece length"
+//	Comment     string `bencode:"comment,omitempty"` // skipped if empty
+//	Internal    int `bencode:"-"`                   // never encoded
+//
+// Unexported fields are ignored. The fields of an embedded struct are encoded
+// as if they were in the outer struct, unless the embedded field has a tag
+// giving it a name; they are left out if it is a nil pointer. When several
+// fields want the same key, the rules of encoding/json pick one or none.
+func Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := marshalValue(&b, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writer is satisfied by both *bytes.Buffer and *bufio.Writer, so the same
+// code can build a []byte for Marshal or stream to an io.Writer for Encoder.
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+func marshalValue(b writer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencoding: cannot marshal nil value")
+	}
+
+	if v.Type().Implements(marshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return fmt.Errorf("bencoding: cannot marshal nil %v", v.Type())
+		}
+		return marshalMarshaler(b, v.Interface().(Marshaler))
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return marshalMarshaler(b, v.Addr().Interface().(Marshaler))
+	}
+
+	if v.Type() == bigIntType {
+		var i *big.Int
+		if v.CanAddr() {
+			i = v.Addr().Interface().(*big.Int)
+		} else {
+			x := v.Interface().(big.Int)
+			i = &x
+		}
+		b.WriteByte('i')
+		b.WriteString(i.String())
+		b.WriteByte('e')
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			b.WriteString("i1e")
+		} else {
+			b.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.WriteByte('i')
+		b.WriteString(strconv.FormatInt(v.Int(), 10))
+		b.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b.WriteByte('i')
+		b.WriteString(strconv.FormatUint(v.Uint(), 10))
+		b.WriteByte('e')
+	case reflect.String:
+		writeString(b, v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			writeBytes(b, v.Bytes())
+			return nil
+		}
+		return marshalList(b, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(s), v)
+			writeBytes(b, s)
+			return nil
+		}
+		return marshalList(b, v)
+	case reflect.Map:
+		return marshalMap(b, v)
+	case reflect.Struct:
+		return marshalStruct(b, v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencoding: cannot marshal nil %v", v.Type())
+		}
+		return marshalValue(b, v.Elem())
+	default:
+		return fmt.Errorf("bencoding: unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+func marshalMarshaler(b writer, m Marshaler) error {
+	raw, err := m.MarshalBencode()
+	if err != nil {
+		return fmt.Errorf("bencoding: error calling MarshalBencode for %T: %w", m, err)
+	}
+	b.Write(raw)
+	return nil
+}
+
+func writeString(b writer, s string) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.WriteString(s)
+}
+
+// writeBytes is writeString for byte slices, which saves converting (and so
+// copying) them to strings.
+func writeBytes(b writer, s []byte) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.Write(s)
+}
+
+func marshalList(b writer, v reflect.Value) error {
+	b.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := marshalValue(b, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('e')
+	return nil
+}
+
+func marshalMap(b writer, v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("bencoding: unsupported map key type %v", v.Type().Key())
+	}
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	b.WriteByte('d')
+	for _, key := range keys {
+		writeString(b, key.String())
+		if err := marshalValue(b, v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('e')
+	return nil
+}
+
+func marshalStruct(b writer, v reflect.Value) error {
+	b.WriteByte('d')
+	for _, f := range cachedStructFields(v.Type()).list {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		writeString(b, f.name)
+		if err := marshalValue(b, fv); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('e')
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field describes how a single struct field maps to a dictionary key.
+type field struct {
+	name      string
+	index     []int // path through embedded structs, as for reflect.Value.FieldByIndex
+	tagged    bool
+	omitEmpty bool
+}
+
+// structFields holds the encodable fields of a struct type.
+type structFields struct {
+	list   []field // sorted by key, as they must appear in a bencoded dict
+	byName map[string]int
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+// cachedStructFields returns the encodable fields of t, working them out the
+// first time t is seen. Fields of embedded structs are promoted, and clashing
+// names are settled as encoding/json does: the shallowest field wins, then a
+// tagged one, and if that still leaves more than one the name is dropped.
+func cachedStructFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	var all []field
+	collectFields(t, nil, map[reflect.Type]bool{t: true}, &all)
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		if len(all[i].index) != len(all[j].index) {
+			return len(all[i].index) < len(all[j].index)
+		}
+		return all[i].tagged && !all[j].tagged
+	})
+
+	fields := &structFields{byName: make(map[string]int)}
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].name == all[i].name {
+			j++
+		}
+		if j == i+1 || len(all[i].index) < len(all[i+1].index) || all[i].tagged && !all[i+1].tagged {
+			fields.byName[all[i].name] = len(fields.list)
+			fields.list = append(fields.list, all[i])
+		}
+		i = j
+	}
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.(*structFields)
+}
+
+// collectFields appends the fields of t to out, descending into untagged
+// embedded structs. seen holds the struct types on the current path, so that
+// a type embedding a pointer to itself doesn't recurse forever.
+func collectFields(t reflect.Type, index []int, seen map[reflect.Type]bool, out *[]field) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.PkgPath != "" && !(sf.Anonymous && ft.Kind() == reflect.Struct) { // unexported
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		f := field{name: sf.Name, index: append(append([]int(nil), index...), i)}
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			f.name = parts[0]
+			f.tagged = true
+		}
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		if sf.Anonymous && !f.tagged && ft.Kind() == reflect.Struct {
+			if !seen[ft] {
+				seen[ft] = true
+				collectFields(ft, f.index, seen, out)
+				delete(seen, ft)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		*out = append(*out, f)
+	}
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but reports false instead
+// of panicking when it meets a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+var unmarshalerCache sync.Map // map[reflect.Type]bool
+
+// implementsUnmarshaler reports whether *t implements Unmarshaler. This is
+// checked for every value decoded, so it's worth remembering.
+func implementsUnmarshaler(t reflect.Type) bool {
+	if ok, found := unmarshalerCache.Load(t); found {
+		return ok.(bool)
+	}
+	ok := reflect.PtrTo(t).Implements(unmarshalerType)
+	unmarshalerCache.Store(t, ok)
+	return ok
+}
@@ -0,0 +1,367 @@
+package bencoding
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Length      int        `bencode:"length,omitempty"`
+	Private     bool       `bencode:"private,omitempty"`
+}
+
+type testTorrent struct {
+	Announce   string    `bencode:"announce"`
+	Comment    string    `bencode:"comment,omitempty"`
+	Info       *testInfo `bencode:"info"`
+	Ignored    string    `bencode:"-"`
+	unexported int
+}
+
+// upper is a custom type that stores its value upper-cased and encodes it
+// lower-cased.
+type upper string
+
+func (u upper) MarshalBencode() ([]byte, error) {
+	return Marshal(strings.ToLower(string(u)))
+}
+
+func (u *upper) UnmarshalBencode(b []byte) error {
+	var s string
+	if err := Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*u = upper(strings.ToUpper(s))
+	return nil
+}
+
+func TestMarshal(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want string
+	}{
+		{0, "i0e"},
+		{int64(-12), "i-12e"},
+		{uint8(200), "i200e"},
+		{true, "i1e"},
+		{"spam", "4:spam"},
+		{[]byte("eggs"), "4:eggs"},
+		{[3]byte{'a', 'b', 'c'}, "3:abc"},
+		{[]string{"spam", "eggs"}, "l4:spam4:eggse"},
+		{[]int(nil), "le"},
+		{map[string]int{"two": 2, "one": 1}, "d3:onei1e3:twoi2ee"},
+		{upper("MOO"), "3:moo"},
+		{
+			testTorrent{Announce: "a", Info: &testInfo{Name: "n", PieceLength: 1, Pieces: []byte("p")}, Ignored: "x"},
+			"d8:announce1:a4:infod4:name1:n12:piece lengthi1e6:pieces1:pee",
+		},
+	}
+	for _, c := range cases {
+		got, err := Marshal(c.in)
+		if err != nil {
+			t.Errorf("Marshal(%#v) returned error %v", c.in, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("Marshal(%#v) == %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	cases := []interface{}{
+		nil,
+		1.5,
+		map[int]int{1: 1},
+		(*testInfo)(nil),
+		struct{ M Marshaler }{},
+	}
+	for _, c := range cases {
+		if got, err := Marshal(c); err == nil {
+			t.Errorf("Marshal(%#v) == %q, want error", c, got)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var tor testTorrent
+	in := "d8:announce1:a7:comment3:hi!4:infod5:filesld6:lengthi3e4:pathl1:a1:beee4:name1:n12:piece lengthi16384e6:pieces2:pp7:privatei1ee7:unknowni0ee"
+	if err := Unmarshal([]byte(in), &tor); err != nil {
+		t.Fatal(err)
+	}
+	want := testTorrent{
+		Announce: "a",
+		Comment:  "hi!",
+		Info: &testInfo{
+			Name:        "n",
+			PieceLength: 16384,
+			Pieces:      []byte("pp"),
+			Files:       []testFile{{Length: 3, Path: []string{"a", "b"}}},
+			Private:     true,
+		},
+	}
+	if !reflect.DeepEqual(tor, want) {
+		t.Errorf("Unmarshal(%q) == %+v, want %+v", in, tor, want)
+	}
+}
+
+type testBase struct {
+	Name string `bencode:"name"`
+	Size int    `bencode:"size"`
+}
+
+type testExtra struct {
+	Size int `bencode:"size"`
+	Note string
+}
+
+func TestMarshalFieldConflicts(t *testing.T) {
+	type Base testBase
+	cases := []struct {
+		in   interface{}
+		want string
+	}{
+		// Two tagged fields at the same depth cancel out.
+		{struct {
+			A int `bencode:"x"`
+			B int `bencode:"x"`
+			C int `bencode:"y"`
+		}{1, 2, 3}, "d1:yi3ee"},
+		// A tagged field beats an untagged one of the same name.
+		{struct {
+			X int
+			Y int `bencode:"X"`
+		}{1, 2}, "d1:Xi2ee"},
+		// Embedded fields are promoted, and the outer struct's win.
+		{struct {
+			testBase
+			Name string `bencode:"name"`
+		}{testBase{"inner", 3}, "outer"}, "d4:name5:outer4:sizei3ee"},
+		// Fields promoted from two embedded structs at the same depth clash.
+		{struct {
+			testBase
+			*testExtra
+		}{testBase{"n", 1}, &testExtra{2, "hi"}}, "d4:Note2:hi4:name1:ne"},
+		// A nil embedded pointer contributes nothing.
+		{struct {
+			testBase
+			*testExtra
+		}{testBase{"n", 1}, nil}, "d4:name1:ne"},
+		// A tag names the embedded struct instead of flattening it.
+		{struct {
+			Base `bencode:"base"`
+		}{Base{"n", 1}}, "d4:based4:name1:n4:sizei1eee"},
+	}
+	for _, c := range cases {
+		got, err := Marshal(c.in)
+		if err != nil {
+			t.Errorf("Marshal(%+v) returned error %v", c.in, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("Marshal(%+v) == %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestUnmarshalEmbedded(t *testing.T) {
+	type Extra struct {
+		Note string `bencode:"note"`
+	}
+	var got struct {
+		testBase
+		*Extra
+		Size int `bencode:"size"`
+	}
+	in := "d4:name1:n4:note2:hi4:sizei5ee"
+	if err := Unmarshal([]byte(in), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "n" || got.Extra == nil || got.Note != "hi" || got.Size != 5 || got.testBase.Size != 0 {
+		t.Errorf("Unmarshal(%q) == %+v", in, got)
+	}
+
+	var private struct {
+		*testExtra
+	}
+	if err := Unmarshal([]byte("d4:sizei1ee"), &private); err == nil {
+		t.Error("Unmarshal through a nil pointer to an unexported struct succeeded")
+	}
+}
+
+func TestUnmarshalCustom(t *testing.T) {
+	var got struct {
+		Sound upper            `bencode:"sound"`
+		Extra map[string]upper `bencode:"extra"`
+	}
+	if err := Unmarshal([]byte("d5:extrad1:a2:bce5:sound3:mooe"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Sound != "MOO" || got.Extra["a"] != "BC" {
+		t.Errorf("got %+v, want MOO and BC", got)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	cases := []struct {
+		in string
+		v  interface{}
+	}{
+		{"i1e", new(string)},
+		{"3:abc", new(int)},
+		{"i256e", new(uint8)},
+		{"i-1e", new(uint)},
+		{"i2e", new(bool)},
+		{"3:abc", new([2]byte)},
+		{"le", new(map[string]int)},
+		{"d1:ai1ee", new([]int)},
+		{"d4:name3:abce", &struct {
+			Name int `bencode:"name"`
+		}{}},
+	}
+	for _, c := range cases {
+		if err := Unmarshal([]byte(c.in), c.v); err == nil {
+			t.Errorf("Unmarshal(%q, %T) returned no error", c.in, c.v)
+		}
+	}
+
+	var i int
+	if err := Unmarshal([]byte("i1e"), i); err == nil {
+		t.Errorf("Unmarshal into non-pointer returned no error")
+	}
+}
+
+func TestRoundTripMarshalUnmarshal(t *testing.T) {
+	file, err := os.Open("../testdata/debian-11.2.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	debtorrent, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct {
+		Announce     string   `bencode:"announce"`
+		Comment      string   `bencode:"comment"`
+		CreationDate int      `bencode:"creation date"`
+		HTTPSeeds    []string `bencode:"httpseeds"`
+		Info         testInfo `bencode:"info"`
+	}
+	if err := Unmarshal(debtorrent, &v); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, debtorrent) {
+		t.Errorf("Marshal(Unmarshal(debtorrent)) differs from original")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	// Deliberately non-canonical: unsorted keys and a leading zero
+	in := []byte("d4:infod1:bi1e1:ai01ee4:name1:xe")
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+	if err := Unmarshal(in, &v); err != nil {
+		t.Fatal(err)
+	}
+	if want := "d1:bi1e1:ai01ee"; string(v.Info) != want {
+		t.Errorf("Info == %q, want %q", v.Info, want)
+	}
+
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("Marshal == %q, want %q", out, in)
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	var v struct {
+		I64 int64    `bencode:"i64"`
+		U64 uint64   `bencode:"u64"`
+		Big *big.Int `bencode:"big"`
+	}
+	in := "d3:bigi123456789012345678901234567890e3:i64i-9223372036854775808e3:u64i18446744073709551615ee"
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.I64 != math.MinInt64 || v.U64 != math.MaxUint64 || v.Big.String() != "123456789012345678901234567890" {
+		t.Errorf("Unmarshal(%q) == %+v", in, v)
+	}
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("Marshal(%+v) == %q, want %q", v, out, in)
+	}
+
+	// Too big for the generic form, unless asked for
+	huge := []byte("i18446744073709551615e")
+	if _, err := Decode(huge); err == nil {
+		t.Errorf("Decode(%q) returned no error", huge)
+	}
+	got, err := (&DecodeOptions{UseBigInt: true}).Decode(huge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, ok := got.(*big.Int); !ok || i.String() != "18446744073709551615" {
+		t.Errorf("Decode(%q) with UseBigInt == %#v", huge, got)
+	}
+	if i, err := (&DecodeOptions{UseBigInt: true}).Decode([]byte("i1e")); err != nil || i != int64(1) {
+		t.Errorf("Decode(\"i1e\") with UseBigInt == %#v, %v, want int64(1)", i, err)
+	}
+}
+
+func TestEncodeIntegerKinds(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want string
+	}{
+		{int(-7), "i-7e"},
+		{int8(-7), "i-7e"},
+		{int16(-7), "i-7e"},
+		{int32(-7), "i-7e"},
+		{int64(math.MinInt64), "i-9223372036854775808e"},
+		{uint(7), "i7e"},
+		{uint8(7), "i7e"},
+		{uint16(7), "i7e"},
+		{uint32(7), "i7e"},
+		{uint64(math.MaxUint64), "i18446744073709551615e"},
+		{big.NewInt(7), "i7e"},
+	}
+	for _, c := range cases {
+		got, err := Encode(c.in)
+		if err != nil {
+			t.Errorf("Encode(%T) returned error %v", c.in, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("Encode(%T(%v)) == %q, want %q", c.in, c.in, got, c.want)
+		}
+	}
+}
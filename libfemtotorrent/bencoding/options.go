@@ -0,0 +1,152 @@
+package bencoding
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// DefaultMaxDepth is the nesting depth allowed when DecodeOptions.MaxDepth is
+// left at zero. It's far deeper than any real torrent or tracker response,
+// but shallow enough that hostile input can't exhaust the stack.
+const DefaultMaxDepth = 256
+
+// DecodeOptions controls how strictly bencoded input is validated. The zero
+// value is the lenient behaviour of Decode and Unmarshal.
+type DecodeOptions struct {
+	// Strict rejects every non-canonical encoding: leading zeros in integers
+	// and string lengths, "i-0e", and dictionary keys that are unsorted or
+	// duplicated. Only input that would re-encode to exactly the same bytes
+	// is accepted.
+	Strict bool
+
+	// MaxDepth limits how deeply lists and dictionaries may be nested. Zero
+	// means DefaultMaxDepth.
+	MaxDepth int
+
+	// MaxStringLength limits the length of any single string. Zero means no
+	// limit beyond the size of the input.
+	MaxStringLength int
+
+	// UseBigInt makes integers that don't fit in an int64 decode into the
+	// generic form as *big.Int, rather than failing with RuleIntegerRange.
+	UseBigInt bool
+}
+
+func (o *DecodeOptions) maxDepth() int {
+	if o.MaxDepth == 0 {
+		return DefaultMaxDepth
+	}
+	return o.MaxDepth
+}
+
+// Unmarshal is like the package-level Unmarshal, but validates data according
+// to o.
+func (o *DecodeOptions) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bencoding: Unmarshal requires a non-nil pointer, got %T", v)
+	}
+	d := decodeState{data: data, opts: o}
+	if err := d.value(rv.Elem(), ""); err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return d.error(RuleTrailingData, d.off, fmt.Sprintf("%q", d.data[d.off:]))
+	}
+	return nil
+}
+
+// Decode is like the package-level Decode, but validates b according to o.
+func (o *DecodeOptions) Decode(b []byte) (interface{}, error) {
+	var result interface{}
+	if err := o.Unmarshal(b, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// NewDecoder is like the package-level NewDecoder, but the returned Decoder
+// validates its input according to o.
+func (o *DecodeOptions) NewDecoder(r io.Reader) *Decoder {
+	dec := NewDecoder(r)
+	dec.opts = *o
+	return dec
+}
+
+// A Rule identifies the requirement a SyntaxError violated.
+type Rule int
+
+const (
+	RuleUnexpectedEnd Rule = iota + 1
+	RuleInvalidCharacter
+	RuleMalformedInteger
+	RuleIntegerRange
+	RuleNonStringKey
+	RuleTrailingData
+	RuleMaxDepth
+	RuleMaxStringLength
+
+	// Only enforced in strict mode
+	RuleLeadingZero
+	RuleNegativeZero
+	RuleUnsortedKeys
+	RuleDuplicateKey
+)
+
+var ruleNames = map[Rule]string{
+	RuleUnexpectedEnd:    "unexpected end of input",
+	RuleInvalidCharacter: "invalid character",
+	RuleMalformedInteger: "malformed integer",
+	RuleIntegerRange:     "integer out of range",
+	RuleNonStringKey:     "dictionary key is not a string",
+	RuleTrailingData:     "data after top-level value",
+	RuleMaxDepth:         "maximum nesting depth exceeded",
+	RuleMaxStringLength:  "maximum string length exceeded",
+	RuleLeadingZero:      "leading zero",
+	RuleNegativeZero:     "negative zero",
+	RuleUnsortedKeys:     "dictionary keys out of order",
+	RuleDuplicateKey:     "duplicate dictionary key",
+}
+
+func (r Rule) String() string {
+	if name, ok := ruleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Rule(%d)", int(r))
+}
+
+// A SyntaxError describes input that isn't valid bencoding (or, in strict
+// mode, isn't canonical bencoding).
+type SyntaxError struct {
+	Offset int64 // byte offset in the input at which the problem was found
+	Rule   Rule  // the rule that was violated
+	detail string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.detail != "" {
+		return fmt.Sprintf("bencoding: %v at offset %v: %v", e.Rule, e.Offset, e.detail)
+	}
+	return fmt.Sprintf("bencoding: %v at offset %v", e.Rule, e.Offset)
+}
+
+// checkDigits checks the digits of an integer or string length, returning the
+// rule they violate, if any. Only integers may be negative.
+func checkDigits(digits []byte, integer, strict bool) (Rule, bool) {
+	negative := integer && len(digits) > 0 && digits[0] == '-'
+	if negative {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return RuleMalformedInteger, false
+	}
+	if strict && digits[0] == '0' {
+		if len(digits) > 1 {
+			return RuleLeadingZero, false
+		} else if negative {
+			return RuleNegativeZero, false
+		}
+	}
+	return 0, true
+}
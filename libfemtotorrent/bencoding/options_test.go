@@ -0,0 +1,115 @@
+package bencoding
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSyntaxErrors(t *testing.T) {
+	cases := []struct {
+		in     string
+		opts   DecodeOptions
+		rule   Rule
+		offset int64
+	}{
+		// Truncated input
+		{"", DecodeOptions{}, RuleUnexpectedEnd, 0},
+		{"l", DecodeOptions{}, RuleUnexpectedEnd, 1},
+		{"d3:foo", DecodeOptions{}, RuleUnexpectedEnd, 6},
+		{"5:ab", DecodeOptions{}, RuleUnexpectedEnd, 4},
+		{"i12", DecodeOptions{}, RuleUnexpectedEnd, 3},
+		{"li1e", DecodeOptions{}, RuleUnexpectedEnd, 4},
+
+		// Always invalid
+		{"x", DecodeOptions{}, RuleInvalidCharacter, 0},
+		{"i1xe", DecodeOptions{}, RuleInvalidCharacter, 2},
+		{"ie", DecodeOptions{}, RuleMalformedInteger, 1},
+		{"i-e", DecodeOptions{}, RuleMalformedInteger, 1},
+		{"i99999999999999999999e", DecodeOptions{}, RuleIntegerRange, 1},
+		{"di1ei2ee", DecodeOptions{}, RuleNonStringKey, 1},
+		{"i1ei2e", DecodeOptions{}, RuleTrailingData, 3},
+		{"lllleeee", DecodeOptions{MaxDepth: 3}, RuleMaxDepth, 3},
+		{"l5:abcdee", DecodeOptions{MaxStringLength: 4}, RuleMaxStringLength, 1},
+		{"10:abc", DecodeOptions{MaxStringLength: 4}, RuleMaxStringLength, 0},
+		{"99999999999999999999:abc", DecodeOptions{MaxStringLength: 4}, RuleMaxStringLength, 0},
+		{"3000000000:abc", DecodeOptions{}, RuleIntegerRange, 0},
+		{"99999999999999999999:abc", DecodeOptions{}, RuleIntegerRange, 0},
+		{strings.Repeat("l", DefaultMaxDepth+1), DecodeOptions{}, RuleMaxDepth, DefaultMaxDepth},
+
+		// Only invalid in strict mode
+		{"i03e", DecodeOptions{Strict: true}, RuleLeadingZero, 1},
+		{"i-03e", DecodeOptions{Strict: true}, RuleLeadingZero, 1},
+		{"i-0e", DecodeOptions{Strict: true}, RuleNegativeZero, 1},
+		{"03:abc", DecodeOptions{Strict: true}, RuleLeadingZero, 0},
+		{"d1:bi1e1:ai2ee", DecodeOptions{Strict: true}, RuleUnsortedKeys, 7},
+		{"d1:ai1e1:ai2ee", DecodeOptions{Strict: true}, RuleDuplicateKey, 7},
+		{"ld1:ai1eed1:bi1e1:ai2eee", DecodeOptions{Strict: true}, RuleUnsortedKeys, 16},
+	}
+	for _, c := range cases {
+		_, err := c.opts.Decode([]byte(c.in))
+		var serr *SyntaxError
+		if !errors.As(err, &serr) {
+			t.Errorf("Decode(%q) returned %v, want *SyntaxError", c.in, err)
+			continue
+		}
+		if serr.Rule != c.rule || serr.Offset != c.offset {
+			t.Errorf("Decode(%q) violated %q at offset %v, want %q at offset %v", c.in, serr.Rule, serr.Offset, c.rule, c.offset)
+		}
+
+		// The streaming decoder reports truncation as io.ErrUnexpectedEOF
+		// (or io.EOF, for empty input) and doesn't know about trailing data.
+		if c.rule == RuleUnexpectedEnd || c.rule == RuleTrailingData {
+			continue
+		}
+		var v interface{}
+		err = c.opts.NewDecoder(strings.NewReader(c.in)).Decode(&v)
+		if !errors.As(err, &serr) {
+			t.Errorf("Decoder.Decode(%q) returned %v, want *SyntaxError", c.in, err)
+			continue
+		}
+		if serr.Rule != c.rule || serr.Offset != c.offset {
+			t.Errorf("Decoder.Decode(%q) violated %q at offset %v, want %q at offset %v", c.in, serr.Rule, serr.Offset, c.rule, c.offset)
+		}
+	}
+}
+
+func TestLenientAcceptsNonCanonical(t *testing.T) {
+	cases := []string{
+		"i03e",
+		"i-0e",
+		"03:abc",
+		"d1:bi1e1:ai2ee",
+		"d1:ai1e1:ai2ee",
+	}
+	for _, c := range cases {
+		if _, err := Decode([]byte(c)); err != nil {
+			t.Errorf("Decode(%q) returned error %v", c, err)
+		}
+		var v interface{}
+		if err := NewDecoder(strings.NewReader(c)).Decode(&v); err != nil {
+			t.Errorf("Decoder.Decode(%q) returned error %v", c, err)
+		}
+	}
+}
+
+func TestStrictAcceptsCanonical(t *testing.T) {
+	strict := DecodeOptions{Strict: true}
+	cases := []string{
+		"i0e",
+		"i-10e",
+		"0:",
+		"d1:ai1e1:bi2ee",
+		"ld1:bi1eed1:ai1eee",
+	}
+	for _, c := range cases {
+		if _, err := strict.Decode([]byte(c)); err != nil {
+			t.Errorf("Decode(%q) returned error %v", c, err)
+		}
+		var v interface{}
+		if err := strict.NewDecoder(strings.NewReader(c)).Decode(&v); err != nil && err != io.EOF {
+			t.Errorf("Decoder.Decode(%q) returned error %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package bencoding
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// A Token holds a value of one of these types:
+//
+//	Delim, for the start ('l' or 'd') or end ('e') of a list or dictionary
+//	int64, for integers (or *big.Int, with DecodeOptions.UseBigInt)
+//	[]byte, for strings
+type Token interface{}
+
+// A Delim is one of the container delimiters 'l', 'd' or 'e'.
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// A Decoder reads and decodes bencoded values from an input stream, without
+// ever holding more than the current value in memory.
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+	opts   DecodeOptions
+
+	// stack holds every container we're currently inside. For dicts, wantKey
+	// tracks whether the next token must be a key.
+	stack   []container
+	wantKey bool
+
+	// When capturing, every byte read is also appended to raw, so Decode can
+	// hand a complete value to Unmarshal.
+	capturing bool
+	raw       []byte
+
+	// scratch holds the digits of the integer or string length being read,
+	// so they don't need allocating.
+	scratch [24]byte
+}
+
+type container struct {
+	delim   Delim
+	lastKey []byte // for dicts in strict mode, to check key order
+}
+
+// NewDecoder returns a new decoder that reads from r. Like Unmarshal, it is
+// lenient about non-canonical input; use DecodeOptions.NewDecoder for strict
+// validation.
+//
+// The decoder introduces its own buffering and may read data from r beyond
+// the values requested.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Token returns the next bencoded token in the input stream. At the end of the
+// input stream, Token returns nil, io.EOF. If the input ends part way through
+// a value, Token returns io.ErrUnexpectedEOF; other malformed input results in
+// a *SyntaxError.
+//
+// Strings are read into memory in full, but lists and dictionaries are
+// returned one element at a time, so arbitrarily large containers can be
+// walked with bounded memory.
+func (d *Decoder) Token() (Token, error) {
+	return d.readToken()
+}
+
+// More reports whether there is another element in the current list or
+// dictionary being parsed.
+func (d *Decoder) More() bool {
+	c, err := d.r.Peek(1)
+	return err == nil && c[0] != 'e'
+}
+
+// Decode reads the next bencoded value from its input and stores it in the
+// value pointed to by v, as described in the documentation for Unmarshal.
+//
+// Decode may be mixed with calls to Token, e.g. to walk into a large
+// dictionary and decode only some of its values.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bencoding: Decode requires a non-nil pointer, got %T", v)
+	}
+
+	// Unmarshal may keep references into the raw bytes, so we can't reuse the
+	// buffer between calls.
+	d.raw = nil
+	d.capturing = true
+	defer func() { d.capturing = false }()
+
+	depth := 0
+	for {
+		tok, err := d.readToken()
+		if err == io.EOF && len(d.raw) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if delim, ok := tok.(Delim); ok {
+			if delim == 'e' {
+				if depth == 0 {
+					return &SyntaxError{Offset: d.offset - 1, Rule: RuleInvalidCharacter, detail: "end of enclosing container"}
+				}
+				depth--
+			} else {
+				depth++
+			}
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	return d.opts.Unmarshal(d.raw, v)
+}
+
+// InputOffset returns the input stream byte offset of the current decoder
+// position. Together with Token, it gives the location of every value in the
+// stream, e.g. to capture the original bytes of a particular value.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	if d.capturing {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+// maxPrealloc is the longest string we'll trust the length prefix of enough to
+// allocate space for up front. Longer strings must actually arrive before
+// we'll allocate for them.
+const maxPrealloc = 1 << 20
+
+// readString reads the body of a string of the given length.
+func (d *Decoder) readString(length int) ([]byte, error) {
+	var s []byte
+	var err error
+	switch {
+	case d.capturing && length <= maxPrealloc:
+		// Read straight into raw, rather than reading and then copying
+		n := len(d.raw)
+		if cap(d.raw)-n < length {
+			grown := make([]byte, n, 2*cap(d.raw)+length)
+			copy(grown, d.raw)
+			d.raw = grown
+		}
+		d.raw = d.raw[:n+length]
+		var read int
+		read, err = io.ReadFull(d.r, d.raw[n:])
+		d.offset += int64(read)
+		s = d.raw[n : n+length : n+length]
+	case length <= maxPrealloc:
+		s = make([]byte, length)
+		var read int
+		read, err = io.ReadFull(d.r, s)
+		d.offset += int64(read)
+	default:
+		s, err = ioutil.ReadAll(io.LimitReader(d.r, int64(length)))
+		d.offset += int64(len(s))
+		if err == nil && len(s) != length {
+			err = io.ErrUnexpectedEOF
+		}
+		if d.capturing {
+			d.raw = append(d.raw, s...)
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return s, err
+}
+
+func (d *Decoder) error(rule Rule, offset int64, detail string) *SyntaxError {
+	return &SyntaxError{Offset: offset, Rule: rule, detail: detail}
+}
+
+// maxDigits is the most digits, not counting a '-', that Decoder reads of a
+// string length or of an integer that isn't to be a big.Int. It's enough for
+// any int64 or uint64, and stops an endless run of digits using up memory.
+const maxDigits = 20
+
+// readDigits reads the digits of an integer or string length up to and
+// including the terminator, returning them appended to digits.
+func (d *Decoder) readDigits(digits []byte, terminator byte, integer bool) ([]byte, error) {
+	start := d.offset - int64(len(digits))
+	for {
+		c, err := d.readByte()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == terminator:
+			if rule, ok := checkDigits(digits, integer, d.opts.Strict); !ok {
+				return nil, d.error(rule, start, fmt.Sprintf("%q", digits))
+			}
+			return digits, nil
+		case '0' <= c && c <= '9':
+			n := len(digits)
+			if n > 0 && digits[0] == '-' {
+				n--
+			}
+			if n == maxDigits && !(integer && d.opts.UseBigInt) {
+				return nil, d.error(RuleIntegerRange, start, fmt.Sprintf("more than %v digits", maxDigits))
+			}
+			digits = append(digits, c)
+		case c == '-' && integer && len(digits) == 0:
+			digits = append(digits, c)
+		default:
+			return nil, d.error(RuleInvalidCharacter, d.offset-1, fmt.Sprintf("expected %q, got %q", terminator, c))
+		}
+	}
+}
+
+func (d *Decoder) readToken() (Token, error) {
+	start := d.offset
+	c, err := d.readByte()
+	if err == io.EOF && len(d.stack) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	isKey := d.wantKey
+	if isKey && c != 'e' && (c < '0' || c > '9') {
+		return nil, d.error(RuleNonStringKey, start, fmt.Sprintf("got %q", c))
+	}
+
+	var tok Token
+	switch {
+	case c == 'l' || c == 'd':
+		if len(d.stack) >= d.opts.maxDepth() {
+			return nil, d.error(RuleMaxDepth, start, "")
+		}
+		d.stack = append(d.stack, container{delim: Delim(c)})
+		d.wantKey = c == 'd'
+		return Delim(c), nil
+	case c == 'e':
+		if len(d.stack) == 0 {
+			return nil, d.error(RuleInvalidCharacter, start, "'e' outside of a container")
+		}
+		if d.stack[len(d.stack)-1].delim == 'd' && !d.wantKey {
+			return nil, d.error(RuleInvalidCharacter, start, "missing value for dictionary key")
+		}
+		d.stack = d.stack[:len(d.stack)-1]
+		// A container is never a key, so if we're back in a dict we've just
+		// finished one of its values.
+		d.wantKey = len(d.stack) > 0 && d.stack[len(d.stack)-1].delim == 'd'
+		return Delim('e'), nil
+	case c == 'i':
+		digits, err := d.readDigits(d.scratch[:0], 'e', true)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := parseInteger(digits, d.opts.UseBigInt)
+		if !ok {
+			return nil, d.error(RuleIntegerRange, start+1, string(digits))
+		}
+		tok = i
+	case '0' <= c && c <= '9':
+		digits, err := d.readDigits(append(d.scratch[:0], c), ':', false)
+		if err != nil {
+			return nil, err
+		}
+		length, ok := parseUint64(digits)
+		if d.opts.MaxStringLength > 0 && (!ok || length > uint64(d.opts.MaxStringLength)) {
+			return nil, d.error(RuleMaxStringLength, start, fmt.Sprintf("length %s", digits))
+		}
+		// Strings are read whole, so this is as long as one can be
+		if !ok || length > math.MaxInt32 {
+			return nil, d.error(RuleIntegerRange, start, fmt.Sprintf("length %s", digits))
+		}
+		s, err := d.readString(int(length))
+		if err != nil {
+			return nil, err
+		}
+		if isKey && d.opts.Strict {
+			top := &d.stack[len(d.stack)-1]
+			if top.lastKey != nil {
+				if cmp := bytes.Compare(top.lastKey, s); cmp == 0 {
+					return nil, d.error(RuleDuplicateKey, start, fmt.Sprintf("%q", s))
+				} else if cmp > 0 {
+					return nil, d.error(RuleUnsortedKeys, start, fmt.Sprintf("%q after %q", s, top.lastKey))
+				}
+			}
+			top.lastKey = s
+		}
+		tok = s
+	default:
+		return nil, d.error(RuleInvalidCharacter, start, fmt.Sprintf("%q", c))
+	}
+
+	// Having read a complete value, work out what the enclosing container
+	// expects next.
+	if len(d.stack) > 0 && d.stack[len(d.stack)-1].delim == 'd' {
+		d.wantKey = !isKey
+	} else {
+		d.wantKey = false
+	}
+	return tok, nil
+}
+
+// An Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	out   io.Writer
+	w     *bufio.Writer
+	depth int
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{out: w, w: bufio.NewWriter(w)}
+}
+
+// Encode writes the bencoding of v to the stream, as described in the
+// documentation for Marshal. If v can't be encoded, the part of it that didn't
+// fit in the encoder's buffer may already have been written.
+func (e *Encoder) Encode(v interface{}) error {
+	if err := marshalValue(e.w, reflect.ValueOf(v)); err != nil {
+		e.w.Reset(e.out)
+		return err
+	}
+	return e.w.Flush()
+}
+
+// EncodeToken writes a single token to the stream. Together with Encode, this
+// allows large lists and dictionaries to be written an element at a time. It
+// is the caller's responsibility to write dictionary keys as sorted strings.
+func (e *Encoder) EncodeToken(t Token) error {
+	switch t := t.(type) {
+	case Delim:
+		switch t {
+		case 'l', 'd':
+			e.depth++
+		case 'e':
+			if e.depth == 0 {
+				return errors.New("bencoding: EncodeToken of 'e' outside of a container")
+			}
+			e.depth--
+		default:
+			return fmt.Errorf("bencoding: invalid delimiter %q", byte(t))
+		}
+		e.w.WriteByte(byte(t))
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, *big.Int, []byte, string:
+		if err := marshalValue(e.w, reflect.ValueOf(t)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("bencoding: invalid token type %T", t)
+	}
+	return e.w.Flush()
+}
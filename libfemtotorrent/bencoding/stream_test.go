@@ -0,0 +1,193 @@
+package bencoding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderToken(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d3:cowl3:mooi-2ee4:spam4:eggse"))
+	want := []Token{Delim('d'), []byte("cow"), Delim('l'), []byte("moo"), int64(-2), Delim('e'), []byte("spam"), []byte("eggs"), Delim('e')}
+	for i, w := range want {
+		got, err := dec.Token()
+		if err != nil {
+			t.Fatalf("Token %v returned error %v", i, err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("Token %v == %#v, want %#v", i, got, w)
+		}
+	}
+	if tok, err := dec.Token(); err != io.EOF {
+		t.Errorf("Token at end of input == %#v, %v, want io.EOF", tok, err)
+	}
+}
+
+func TestDecoderTokenErrors(t *testing.T) {
+	cases := []string{
+		"e",
+		"l",
+		"5:ab",
+		"i12",
+		"ixe",
+		"di1ei2ee",
+		"d3:fooe",
+		"x",
+	}
+	for _, c := range cases {
+		dec := NewDecoder(strings.NewReader(c))
+		var err error
+		for err == nil {
+			_, err = dec.Token()
+		}
+		if err == io.EOF {
+			t.Errorf("Tokens of %q ended without error", c)
+		}
+	}
+}
+
+func TestDecoderHugeString(t *testing.T) {
+	cases := []struct {
+		in   string
+		opts DecodeOptions
+		rule Rule
+	}{
+		{"3000000000:abc", DecodeOptions{}, RuleIntegerRange},
+		{"99999999999999999999:abc", DecodeOptions{}, RuleIntegerRange},
+		{"3000000000:abc", DecodeOptions{MaxStringLength: 10}, RuleMaxStringLength},
+		{"99999999999999999999:abc", DecodeOptions{MaxStringLength: 10}, RuleMaxStringLength},
+	}
+	for _, c := range cases {
+		_, err := c.opts.NewDecoder(strings.NewReader(c.in)).Token()
+		var serr *SyntaxError
+		if !errors.As(err, &serr) || serr.Rule != c.rule {
+			t.Errorf("Token of %q with %+v returned %v, want %q", c.in, c.opts, err, c.rule)
+		}
+	}
+}
+
+// digitReader reads as an endless run of 1s.
+type digitReader struct{}
+
+func (digitReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = '1'
+	}
+	return len(b), nil
+}
+
+func TestDecoderEndlessDigits(t *testing.T) {
+	for _, prefix := range []string{"i", "i-", ""} {
+		dec := NewDecoder(io.MultiReader(strings.NewReader(prefix), digitReader{}))
+		_, err := dec.Token()
+		var serr *SyntaxError
+		if !errors.As(err, &serr) || serr.Rule != RuleIntegerRange {
+			t.Errorf("Token of %q followed by endless digits returned %v, want %q", prefix, err, RuleIntegerRange)
+		}
+	}
+
+	// Big integers can be as long as they like
+	digits := strings.Repeat("1", 100)
+	opts := DecodeOptions{UseBigInt: true}
+	tok, err := opts.NewDecoder(strings.NewReader("i-" + digits + "e")).Token()
+	if i, ok := tok.(*big.Int); err != nil || !ok || i.String() != "-"+digits {
+		t.Errorf("Token of a 100-digit integer == %v, %v, want it as a big.Int", tok, err)
+	}
+}
+
+func TestDecoderDecode(t *testing.T) {
+	// A stream of several values, decoded partly by Token and partly by Decode
+	dec := NewDecoder(strings.NewReader("i1e3:abcd1:ali1ei2ee1:bi3ee"))
+
+	var i int
+	if err := dec.Decode(&i); err != nil || i != 1 {
+		t.Errorf("Decode == %v, %v, want 1", i, err)
+	}
+	var s string
+	if err := dec.Decode(&s); err != nil || s != "abc" {
+		t.Errorf("Decode == %q, %v, want \"abc\"", s, err)
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != Delim('d') {
+		t.Fatalf("Token == %v, %v, want 'd'", tok, err)
+	}
+	got := make(map[string]interface{})
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var val interface{}
+		if err := dec.Decode(&val); err != nil {
+			t.Fatal(err)
+		}
+		got[string(key.([]byte))] = val
+	}
+	want := map[string]interface{}{"a": []interface{}{int64(1), int64(2)}, "b": int64(3)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if tok, err := dec.Token(); err != nil || tok != Delim('e') {
+		t.Errorf("Token == %v, %v, want 'e'", tok, err)
+	}
+	if err := dec.Decode(&i); err != io.EOF {
+		t.Errorf("Decode at end of input returned %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	var v interface{}
+	err := NewDecoder(strings.NewReader("d3:fooli1e")).Decode(&v)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of truncated input returned %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderTorrentFile(t *testing.T) {
+	file, err := os.Open("../testdata/debian-11.2.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var v struct {
+		Announce string `bencode:"announce"`
+	}
+	if err := NewDecoder(file).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Announce != "http://bttracker.debian.org:6969/announce" {
+		t.Errorf("Decode(...).Announce == %v", v.Announce)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	tokens := []Token{Delim('l'), 1, "abc", []byte("de")}
+	for _, tok := range tokens {
+		if err := enc.EncodeToken(tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Encode(map[string]int{"x": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.EncodeToken(Delim('e')); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.EncodeToken(Delim('e')); err == nil {
+		t.Errorf("EncodeToken of unbalanced 'e' returned no error")
+	}
+	if err := enc.Encode(1.5); err == nil {
+		t.Errorf("Encode(1.5) returned no error")
+	}
+	if got, want := b.String(), "li1e3:abc2:ded1:xi1eee"; got != want {
+		t.Errorf("Encoder wrote %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,528 @@
+package bencoding
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// Unmarshal decodes the bencoded data and stores the result in the value
+// pointed to by v, following the same rules as Marshal in reverse.
+//
+// Bencoded strings can be stored in strings, byte slices and byte arrays of
+// exactly the right length; integers in any integer kind (or bool) that can
+// hold them; lists in slices and arrays; dictionaries in maps with string keys
+// and in structs. Dictionary keys without a matching struct field are
+// ignored. If v is an empty interface, the value is stored as returned by
+// Decode. Types implementing Unmarshaler decode themselves, and are passed
+// the value exactly as it appears in data.
+//
+// To avoid copying, byte slices and RawMessages share memory with data, so
+// data must not be modified while they're in use.
+//
+// Unmarshal is lenient: it accepts non-canonical encodings such as leading
+// zeros. Use DecodeOptions for strict validation.
+func Unmarshal(data []byte, v interface{}) error {
+	return (&DecodeOptions{}).Unmarshal(data, v)
+}
+
+// RawMessage is a raw encoded bencoded value. It can be used to delay
+// decoding part of a message, or to get at the exact bytes of a value as they
+// appeared in the input -- e.g. to hash a torrent's info dictionary.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencoding of m.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, fmt.Errorf("bencoding: cannot marshal empty RawMessage")
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data. (When decoding with Unmarshal, a
+// RawMessage instead shares memory with the input, like a []byte does.)
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+// decodeState walks a bencoded document, storing values directly into their
+// destinations as it goes.
+type decodeState struct {
+	data  []byte
+	off   int
+	opts  *DecodeOptions
+	depth int
+}
+
+func (d *decodeState) error(rule Rule, off int, detail string) *SyntaxError {
+	return &SyntaxError{Offset: int64(off), Rule: rule, detail: detail}
+}
+
+func (d *decodeState) peek() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, d.error(RuleUnexpectedEnd, d.off, "")
+	}
+	return d.data[d.off], nil
+}
+
+// describe names the kind of value starting with c, for error messages.
+func describe(c byte) string {
+	switch {
+	case c == 'i':
+		return "integer"
+	case '0' <= c && c <= '9':
+		return "string"
+	case c == 'l':
+		return "list"
+	case c == 'd':
+		return "dict"
+	}
+	return fmt.Sprintf("%q", c)
+}
+
+// digits reads the digits of an integer or string length, stepping over the
+// terminator that follows them.
+func (d *decodeState) digits(terminator byte, integer bool) ([]byte, error) {
+	start := d.off
+	end := d.off
+	if integer && end < len(d.data) && d.data[end] == '-' {
+		end++
+	}
+	for end < len(d.data) && '0' <= d.data[end] && d.data[end] <= '9' {
+		end++
+	}
+	if end >= len(d.data) {
+		return nil, d.error(RuleUnexpectedEnd, end, "")
+	}
+	if d.data[end] != terminator {
+		return nil, d.error(RuleInvalidCharacter, end, fmt.Sprintf("expected %q, got %q", terminator, d.data[end]))
+	}
+	digits := d.data[start:end]
+	if rule, ok := checkDigits(digits, integer, d.opts.Strict); !ok {
+		return nil, d.error(rule, start, fmt.Sprintf("%q", digits))
+	}
+	d.off = end + 1
+	return digits, nil
+}
+
+// integer reads an integer, including its 'i' and 'e', returning its
+// validated digits. Integers have no size limit, so it's up to the caller to
+// decide what to do with ones that are too big.
+func (d *decodeState) integer() ([]byte, error) {
+	d.off++ // slurp up the 'i'
+	return d.digits('e', true)
+}
+
+// integerInterface reads an integer into the generic form returned by
+// Decode.
+func (d *decodeState) integerInterface() (interface{}, error) {
+	start := d.off + 1
+	digits, err := d.integer()
+	if err != nil {
+		return nil, err
+	}
+	i, ok := parseInteger(digits, d.opts.UseBigInt)
+	if !ok {
+		return nil, d.error(RuleIntegerRange, start, string(digits))
+	}
+	return i, nil
+}
+
+// parseInteger converts validated integer digits into an int64 or, if they
+// don't fit and useBigInt is set, a *big.Int.
+func parseInteger(digits []byte, useBigInt bool) (interface{}, bool) {
+	if i, ok := parseInt64(digits); ok {
+		return i, true
+	}
+	if !useBigInt {
+		return nil, false
+	}
+	return new(big.Int).SetString(string(digits), 10)
+}
+
+// parseUint64 converts validated digits into a uint64, reporting false if
+// they're negative (other than -0) or overflow. Unlike strconv, it doesn't
+// need the digits converted to a string first, which would allocate.
+func parseUint64(digits []byte) (uint64, bool) {
+	negative := digits[0] == '-'
+	if negative {
+		digits = digits[1:]
+	}
+	var n uint64
+	for _, c := range digits {
+		if n > math.MaxUint64/10 {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+		if n < uint64(c-'0') {
+			return 0, false
+		}
+	}
+	if negative && n != 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseInt64 is like parseUint64, but for int64s.
+func parseInt64(digits []byte) (int64, bool) {
+	if digits[0] != '-' {
+		n, ok := parseUint64(digits)
+		return int64(n), ok && n <= math.MaxInt64
+	}
+	n, ok := parseUint64(digits[1:])
+	return -int64(n), ok && n <= -math.MinInt64
+}
+
+// string reads a length-prefixed string, returning a sub-slice of the input.
+func (d *decodeState) string() ([]byte, error) {
+	start := d.off
+	digits, err := d.digits(':', false)
+	if err != nil {
+		return nil, err
+	}
+	// Checked in the same order as Decoder, so both report the same rule
+	length, ok := parseUint64(digits)
+	if d.opts.MaxStringLength > 0 && (!ok || length > uint64(d.opts.MaxStringLength)) {
+		return nil, d.error(RuleMaxStringLength, start, fmt.Sprintf("length %s", digits))
+	}
+	if !ok || length > math.MaxInt32 {
+		return nil, d.error(RuleIntegerRange, start, fmt.Sprintf("length %s", digits))
+	}
+	if length > uint64(len(d.data)-d.off) {
+		return nil, d.error(RuleUnexpectedEnd, len(d.data), fmt.Sprintf("string of length %s at offset %v", digits, start))
+	}
+	s := d.data[d.off : d.off+int(length)]
+	d.off += int(length)
+	return s, nil
+}
+
+// each calls f for each element of the list or dict starting at the current
+// offset. For dicts, key is set for each value.
+func (d *decodeState) each(f func(key []byte) error) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > d.opts.maxDepth() {
+		return d.error(RuleMaxDepth, d.off, "")
+	}
+
+	isDict := d.data[d.off] == 'd'
+	d.off++ // slurp up the 'l' or 'd'
+	var prev []byte
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.off++
+			return nil
+		}
+		var key []byte
+		if isDict {
+			if c < '0' || c > '9' {
+				return d.error(RuleNonStringKey, d.off, "got "+describe(c))
+			}
+			start := d.off
+			if key, err = d.string(); err != nil {
+				return err
+			}
+			if d.opts.Strict && prev != nil {
+				if cmp := bytes.Compare(prev, key); cmp == 0 {
+					return d.error(RuleDuplicateKey, start, fmt.Sprintf("%q", key))
+				} else if cmp > 0 {
+					return d.error(RuleUnsortedKeys, start, fmt.Sprintf("%q after %q", key, prev))
+				}
+			}
+			prev = key
+		}
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+}
+
+// skip steps over the value at the current offset.
+func (d *decodeState) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		_, err = d.integer()
+	case '0' <= c && c <= '9':
+		_, err = d.string()
+	case c == 'l' || c == 'd':
+		err = d.each(func([]byte) error { return d.skip() })
+	default:
+		err = d.error(RuleInvalidCharacter, d.off, fmt.Sprintf("%q", c))
+	}
+	return err
+}
+
+// valueInterface decodes the value at the current offset into the generic
+// form returned by Decode.
+func (d *decodeState) valueInterface() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		return d.integerInterface()
+	case '0' <= c && c <= '9':
+		return d.string()
+	case c == 'l':
+		var ret []interface{}
+		err := d.each(func([]byte) error {
+			el, err := d.valueInterface()
+			ret = append(ret, el)
+			return err
+		})
+		return ret, err
+	case c == 'd':
+		ret := make(map[string]interface{})
+		err := d.each(func(key []byte) error {
+			// We can't use []byte as a key because slices are unhashable, and
+			// map keys must be hashable. The spec isn't very clear on whether
+			// or not dict keys have to be strings, but in practice it seems
+			// that they always are, so this (usually) works fine.
+			val, err := d.valueInterface()
+			ret[string(key)] = val
+			return err
+		})
+		return ret, err
+	}
+	return nil, d.error(RuleInvalidCharacter, d.off, fmt.Sprintf("%q", c))
+}
+
+// typeError reports that the value starting with c can't be stored in a Go
+// value of type t. It's only built once we know we need it, as it allocates.
+func typeError(c byte, t reflect.Type, key string) error {
+	return &UnmarshalTypeError{Value: describe(c), Type: t, Field: key}
+}
+
+// value decodes the value at the current offset into v. key is the dict key
+// leading to the value, if any, for error messages.
+func (d *decodeState) value(v reflect.Value, key string) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	t := v.Type()
+	if t == rawMessageType {
+		// Special-cased so it can share memory with the input too
+		start := d.off
+		if err := d.skip(); err != nil {
+			return err
+		}
+		v.SetBytes(d.data[start:d.off:d.off])
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && implementsUnmarshaler(t) {
+		start := d.off
+		if err := d.skip(); err != nil {
+			return err
+		}
+		return v.Addr().Interface().(Unmarshaler).UnmarshalBencode(d.data[start:d.off])
+	}
+
+	isString := '0' <= c && c <= '9'
+
+	if t == bigIntType {
+		if c != 'i' {
+			return typeError(c, t, key)
+		}
+		digits, err := d.integer()
+		if err != nil {
+			return err
+		}
+		v.Addr().Interface().(*big.Int).SetString(string(digits), 10)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.value(v.Elem(), key)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError(c, t, key)
+		}
+		decoded, err := d.valueInterface()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(decoded))
+	case reflect.Bool:
+		if c != 'i' {
+			return typeError(c, t, key)
+		}
+		digits, err := d.integer()
+		if err != nil {
+			return err
+		}
+		i, ok := parseInt64(digits)
+		if !ok || (i != 0 && i != 1) {
+			return typeError(c, t, key)
+		}
+		v.SetBool(i == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if c != 'i' {
+			return typeError(c, t, key)
+		}
+		digits, err := d.integer()
+		if err != nil {
+			return err
+		}
+		i, ok := parseInt64(digits)
+		if !ok || v.OverflowInt(i) {
+			return typeError(c, t, key)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if c != 'i' {
+			return typeError(c, t, key)
+		}
+		digits, err := d.integer()
+		if err != nil {
+			return err
+		}
+		i, ok := parseUint64(digits)
+		if !ok || v.OverflowUint(i) {
+			return typeError(c, t, key)
+		}
+		v.SetUint(i)
+	case reflect.String:
+		if !isString {
+			return typeError(c, t, key)
+		}
+		s, err := d.string()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(s))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if !isString {
+				return typeError(c, t, key)
+			}
+			s, err := d.string()
+			if err != nil {
+				return err
+			}
+			// Cap the slice so appending to it can't scribble over the rest
+			// of the input.
+			v.SetBytes(s[:len(s):len(s)])
+			return nil
+		}
+		if c != 'l' {
+			return typeError(c, t, key)
+		}
+		v.SetLen(0)
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(t, 0, 0))
+		}
+		return d.each(func([]byte) error {
+			if v.Len() == v.Cap() {
+				grown := reflect.MakeSlice(t, v.Len(), 2*v.Cap()+4)
+				reflect.Copy(grown, v)
+				v.Set(grown)
+			}
+			v.SetLen(v.Len() + 1)
+			el := v.Index(v.Len() - 1)
+			el.Set(reflect.Zero(t.Elem()))
+			return d.value(el, key)
+		})
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if !isString {
+				return typeError(c, t, key)
+			}
+			s, err := d.string()
+			if err != nil {
+				return err
+			}
+			if len(s) != v.Len() {
+				return typeError(c, t, key)
+			}
+			reflect.Copy(v, reflect.ValueOf(s))
+			return nil
+		}
+		if c != 'l' {
+			return typeError(c, t, key)
+		}
+		i := 0
+		err := d.each(func([]byte) error {
+			if i >= v.Len() {
+				return typeError(c, t, key)
+			}
+			i++
+			return d.value(v.Index(i-1), key)
+		})
+		if err == nil && i != v.Len() {
+			return typeError(c, t, key)
+		}
+		return err
+	case reflect.Map:
+		if c != 'd' || t.Key().Kind() != reflect.String {
+			return typeError(c, t, key)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		return d.each(func(k []byte) error {
+			elem.Set(reflect.Zero(t.Elem()))
+			if err := d.value(elem, string(k)); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(k)).Convert(t.Key()), elem)
+			return nil
+		})
+	case reflect.Struct:
+		if c != 'd' {
+			return typeError(c, t, key)
+		}
+		fields := cachedStructFields(t)
+		return d.each(func(k []byte) error {
+			if i, ok := fields.byName[string(k)]; ok {
+				f := &fields.list[i]
+				fv, err := allocFieldByIndex(v, f.index)
+				if err != nil {
+					return err
+				}
+				return d.value(fv, f.name)
+			}
+			return d.skip()
+		})
+	default:
+		return typeError(c, t, key)
+	}
+	return nil
+}
+
+// allocFieldByIndex is like reflect.Value.FieldByIndex, but allocates any nil
+// embedded pointers on the way.
+func allocFieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("bencoding: cannot set embedded pointer to unexported struct %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
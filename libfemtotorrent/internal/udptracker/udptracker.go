@@ -0,0 +1,28 @@
+// Package udptracker holds the wire format constants of the UDP tracker
+// protocol of BEP 15 (http://bittorrent.org/beps/bep_0015.html), shared by
+// the client in package tracker and the server in package trackerserver.
+package udptracker
+
+// Actions, which say what each request and response is
+const (
+	ActionConnect  = 0
+	ActionAnnounce = 1
+	ActionScrape   = 2
+	ActionError    = 3
+)
+
+// ProtocolID is the magic constant that starts every connect request
+const ProtocolID = 0x41727101980
+
+// MaxScrape is the most info hashes that fit in a single scrape request
+const MaxScrape = 74
+
+// AppendUint32 appends v to b in network byte order.
+func AppendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// AppendUint64 appends v to b in network byte order.
+func AppendUint64(b []byte, v uint64) []byte {
+	return AppendUint32(AppendUint32(b, uint32(v>>32)), uint32(v))
+}
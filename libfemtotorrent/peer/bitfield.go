@@ -0,0 +1,51 @@
+package peer
+
+import "fmt"
+
+// A Bitfield records which pieces of a torrent a peer has, in the form sent
+// in bitfield messages: the high bit of the first byte is piece 0, and any
+// spare bits at the end are zero.
+type Bitfield []byte
+
+// NewBitfield returns an empty Bitfield for a torrent of n pieces.
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// ParseBitfield checks that b is a valid bitfield for a torrent of n pieces,
+// and returns a copy of it.
+func ParseBitfield(b []byte, n int) (Bitfield, error) {
+	if len(b) != (n+7)/8 {
+		return nil, fmt.Errorf("bitfield is %v bytes, want %v for %v pieces", len(b), (n+7)/8, n)
+	}
+	if n%8 != 0 && b[len(b)-1]&(0xff>>(n%8)) != 0 {
+		return nil, fmt.Errorf("bitfield has spare bits set")
+	}
+	return append(Bitfield(nil), b...), nil
+}
+
+// Has reports whether piece i is set.
+func (b Bitfield) Has(i int) bool {
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+// Set marks piece i as present.
+func (b Bitfield) Set(i int) {
+	b[i/8] |= 0x80 >> (i % 8)
+}
+
+// Clear marks piece i as missing.
+func (b Bitfield) Clear(i int) {
+	b[i/8] &^= 0x80 >> (i % 8)
+}
+
+// Count returns how many pieces are set.
+func (b Bitfield) Count() int {
+	n := 0
+	for _, x := range b {
+		for ; x != 0; x &= x - 1 {
+			n++
+		}
+	}
+	return n
+}
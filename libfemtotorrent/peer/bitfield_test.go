@@ -0,0 +1,47 @@
+package peer
+
+import "testing"
+
+func TestBitfield(t *testing.T) {
+	b := NewBitfield(10)
+	if len(b) != 2 || b.Count() != 0 {
+		t.Fatalf("NewBitfield(10) == %v", b)
+	}
+	b.Set(0)
+	b.Set(9)
+	b.Set(9)
+	if b[0] != 0x80 || b[1] != 0x40 {
+		t.Errorf("bitfield with pieces 0 and 9 set is %x", []byte(b))
+	}
+	if !b.Has(0) || b.Has(1) || !b.Has(9) || b.Count() != 2 {
+		t.Errorf("Has(0), Has(1), Has(9), Count() == %v, %v, %v, %v; want true, false, true, 2", b.Has(0), b.Has(1), b.Has(9), b.Count())
+	}
+	b.Clear(0)
+	if b.Has(0) || b.Count() != 1 {
+		t.Errorf("piece 0 still set after Clear(0)")
+	}
+}
+
+func TestParseBitfield(t *testing.T) {
+	cases := []struct {
+		b     []byte
+		n     int
+		valid bool
+	}{
+		{[]byte{0xff, 0xc0}, 10, true},
+		{[]byte{0xff}, 8, true},
+		{[]byte{}, 0, true},
+		{[]byte{0xff, 0xe0}, 10, false}, // Spare bit set
+		{[]byte{0xff}, 10, false},       // Too short
+		{[]byte{0xff, 0, 0}, 10, false}, // Too long
+	}
+	for _, c := range cases {
+		b, err := ParseBitfield(c.b, c.n)
+		if (err == nil) != c.valid {
+			t.Errorf("ParseBitfield(%x, %v) returned error %v, want valid %v", c.b, c.n, err, c.valid)
+		}
+		if err == nil && b.Count() != c.n {
+			t.Errorf("ParseBitfield(%x, %v).Count() == %v", c.b, c.n, b.Count())
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// The extension protocol (BEP 10, http://bittorrent.org/beps/bep_0010.html)
+// is signalled by a bit in the reserved bytes of the handshake. Extension
+// messages are all sent as message type 20; the first byte of the payload
+// says which extension the message is for, 0 being the extension handshake.
+// Each side picks its own ids for the extensions it supports, and tells the
+// other side in the handshake's m dictionary.
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+
+	msgExtended = 20
+
+	extHandshake = 0
+)
+
+// The ids we give the extensions we support, and their names
+const (
+	extTEX     = 1
+	extTEXName = "lt_tex"
+)
+
+const clientVersion = "femtotorrent 0.0.1"
+
+type extensionHandshake struct {
+	M    map[string]int `bencode:"m"`
+	V    string         `bencode:"v,omitempty"`
+	Reqq int            `bencode:"reqq,omitempty"` // How many requests the sender will queue
+	Tr   string         `bencode:"tr,omitempty"`   // trackerListHash of the sender's trackers
+}
+
+// Tracker exchange (BEP 28, http://bittorrent.org/beps/bep_0028.html) lets
+// peers tell each other about trackers for the torrent that work for them.
+// Each tex message lists trackers the sender hasn't sent that peer before.
+const (
+	// texInterval is the least time between tex messages, in either
+	// direction; any that arrive sooner are ignored.
+	texInterval = time.Minute
+
+	// maxTEXAdded is the most trackers we'll take from one message.
+	maxTEXAdded = 20
+)
+
+// trackerListHash is a hash of a list of trackers, sent in the extension
+// handshake so a peer with the same list needn't be sent any: the SHA-1 of
+// the URLs, sorted, each followed by a newline.
+func trackerListHash(urls []string) string {
+	sorted := append([]string(nil), urls...)
+	sort.Strings(sorted)
+	h := sha1.New()
+	for _, u := range sorted {
+		io.WriteString(h, u+"\n")
+	}
+	return string(h.Sum(nil))
+}
+
+type texMessage struct {
+	Added []string `bencode:"added"`
+}
+
+// TrackerExchange is what a Peer needs to swap trackers with the remote peer.
+// *tracker.Manager implements it.
+type TrackerExchange interface {
+	// VerifiedTrackers returns the trackers that are known to work, which
+	// are the only ones we tell peers about.
+	VerifiedTrackers() []string
+
+	// AddTrackers adds trackers learned from a peer. It's responsible for
+	// deduplicating them, and for deciding whether to use them at all.
+	AddTrackers(urls []string)
+}
+
+// texState is a Peer's side of tracker exchange with one remote peer.
+type texState struct {
+	sent         map[string]bool // Sent to or received from the peer
+	lastSent     time.Time
+	lastReceived time.Time
+	remoteHash   string // The tr from the peer's extension handshake
+}
+
+// extensionState is what a Peer knows of the peer's extensions. It's shared
+// by the goroutine reading messages and SendTrackers, so it's set up by the
+// handshake, before either can run.
+type extensionState struct {
+	mu  sync.Mutex
+	ids map[string]int // The peer's ids for its extensions
+	tex texState
+}
+
+// MaxRequests returns how many requests the peer said it will queue, or 0 if
+// it hasn't said. It may be called while another goroutine reads messages.
+func (p *Peer) MaxRequests() int {
+	return int(atomic.LoadInt32(&p.reqq))
+}
+
+// texEnabled reports whether we're doing tracker exchange for tf at all.
+func (p *Peer) texEnabled(tf torrentfile.TorrentFile) bool {
+	return p.Trackers != nil && SourceAllowed(tf, SourceTEX)
+}
+
+func (p *Peer) writeExtended(id uint8, payload interface{}) error {
+	b, err := bencoding.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 6, 6+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(2+len(b)))
+	msg[4] = msgExtended
+	msg[5] = id
+	_, err = p.conn.Write(append(msg, b...))
+	return err
+}
+
+// SendExtensionHandshake sends our extension handshake, if the peer set the
+// extension bit in its handshake. It isn't sent by Connect or Accept because
+// a bitfield must be the first message after the handshake, so it's up to the
+// caller to send it after any bitfield, and before reading messages, whose
+// replies would otherwise go first.
+func (p *Peer) SendExtensionHandshake(tf torrentfile.TorrentFile) error {
+	if p.ext == nil {
+		return nil
+	}
+	hs := extensionHandshake{M: map[string]int{}, V: clientVersion}
+	if p.texEnabled(tf) {
+		hs.M[extTEXName] = extTEX
+		if verified := p.Trackers.VerifiedTrackers(); len(verified) > 0 {
+			hs.Tr = trackerListHash(verified)
+		}
+	}
+	return p.writeExtended(extHandshake, hs)
+}
+
+// handleExtended handles the payload of an extension message.
+func (p *Peer) handleExtended(tf torrentfile.TorrentFile, buf []byte) error {
+	if len(buf) == 0 {
+		return fmt.Errorf("empty extension message")
+	}
+	if p.ext == nil {
+		log.Printf("Ignoring extension message from %v, which didn't set the extension bit", p.Addr())
+		return nil
+	}
+	switch buf[0] {
+	case extHandshake:
+		var hs extensionHandshake
+		if err := bencoding.Unmarshal(buf[1:], &hs); err != nil {
+			return fmt.Errorf("invalid extension handshake: %w", err)
+		}
+		// A later handshake may change some ids, and 0 disables an
+		// extension; anything not mentioned stays as it was.
+		p.ext.mu.Lock()
+		if p.ext.ids == nil {
+			p.ext.ids = make(map[string]int)
+		}
+		for name, id := range hs.M {
+			if id < 0 || id > 255 {
+				continue
+			}
+			if id == 0 {
+				delete(p.ext.ids, name)
+			} else {
+				p.ext.ids[name] = id
+			}
+		}
+		if hs.Tr != "" {
+			p.ext.tex.remoteHash = hs.Tr
+		}
+		p.ext.mu.Unlock()
+		if hs.Reqq > 0 && hs.Reqq <= math.MaxInt32 {
+			atomic.StoreInt32(&p.reqq, int32(hs.Reqq))
+		}
+		if hs.V != "" {
+			log.Printf("Peer %v is running %q", p.Addr(), hs.V)
+		}
+		return p.sendTEX(tf, time.Now())
+	case extTEX:
+		if !p.texEnabled(tf) {
+			return nil
+		}
+		var msg texMessage
+		if err := bencoding.Unmarshal(buf[1:], &msg); err != nil {
+			return fmt.Errorf("invalid tex message: %w", err)
+		}
+		p.receiveTEX(msg, time.Now())
+		return nil
+	}
+	log.Printf("Ignoring extension message %v", buf[0])
+	return nil
+}
+
+func (p *Peer) receiveTEX(msg texMessage, now time.Time) {
+	p.ext.mu.Lock()
+	defer p.ext.mu.Unlock()
+	if !p.ext.tex.lastReceived.IsZero() && now.Sub(p.ext.tex.lastReceived) < texInterval {
+		log.Printf("Ignoring tex message from %v, sent too soon", p.Addr())
+		return
+	}
+	p.ext.tex.lastReceived = now
+	if p.ext.tex.sent == nil {
+		p.ext.tex.sent = make(map[string]bool)
+	}
+	var added []string
+	for _, u := range msg.Added {
+		if len(added) == maxTEXAdded {
+			break
+		}
+		if !p.ext.tex.sent[u] {
+			// No point sending it back
+			p.ext.tex.sent[u] = true
+			added = append(added, u)
+		}
+	}
+	if len(added) > 0 {
+		p.Trackers.AddTrackers(added)
+	}
+}
+
+// SendTrackers tells the peer about any verified trackers it hasn't heard of
+// from us, if it supports tracker exchange and we haven't sent it any for a
+// minute. It's called as messages arrive, but should also be called every so
+// often, for peers that have little to say. It may be called while another
+// goroutine reads messages.
+func (p *Peer) SendTrackers(tf torrentfile.TorrentFile) error {
+	return p.sendTEX(tf, time.Now())
+}
+
+func (p *Peer) sendTEX(tf torrentfile.TorrentFile, now time.Time) error {
+	if p.ext == nil {
+		return nil // Not connected
+	}
+	p.ext.mu.Lock()
+	defer p.ext.mu.Unlock()
+	id, ok := p.ext.ids[extTEXName]
+	if !ok || !p.texEnabled(tf) {
+		return nil
+	}
+	if !p.ext.tex.lastSent.IsZero() && now.Sub(p.ext.tex.lastSent) < texInterval {
+		return nil
+	}
+	if p.ext.tex.sent == nil {
+		p.ext.tex.sent = make(map[string]bool)
+	}
+	verified := p.Trackers.VerifiedTrackers()
+	if p.ext.tex.remoteHash != "" && p.ext.tex.remoteHash == trackerListHash(verified) {
+		// The peer has the same trackers already
+		for _, u := range verified {
+			p.ext.tex.sent[u] = true
+		}
+		return nil
+	}
+	var msg texMessage
+	for _, u := range verified {
+		if !p.ext.tex.sent[u] {
+			msg.Added = append(msg.Added, u)
+		}
+	}
+	if len(msg.Added) == 0 {
+		return nil
+	}
+	if err := p.writeExtended(uint8(id), msg); err != nil {
+		return err
+	}
+	for _, u := range msg.Added {
+		p.ext.tex.sent[u] = true
+	}
+	p.ext.tex.lastSent = now
+	return nil
+}
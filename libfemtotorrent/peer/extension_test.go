@@ -0,0 +1,144 @@
+package peer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+type fakeTrackers struct {
+	verified []string
+	added    []string
+}
+
+func (f *fakeTrackers) VerifiedTrackers() []string { return f.verified }
+func (f *fakeTrackers) AddTrackers(urls []string)  { f.added = append(f.added, urls...) }
+
+// readExtended reads an extension message from conn, returning its id and
+// decoding its payload into v.
+func readExtended(t *testing.T, conn net.Conn, v interface{}) uint8 {
+	t.Helper()
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[4] != msgExtended {
+		t.Fatalf("read message type %v, want %v", header[4], msgExtended)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header)-2)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := bencoding.Unmarshal(payload, v); err != nil {
+		t.Fatal(err)
+	}
+	return header[5]
+}
+
+func TestTEX(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	trackers := &fakeTrackers{verified: []string{"http://a/announce", "udp://b:6969"}}
+	p := &Peer{IPAddress: net.IP{10, 0, 0, 1}, Port: 6881, conn: local, Trackers: trackers, ext: &extensionState{}}
+	var tf torrentfile.TorrentFile
+
+	// Our handshake advertises lt_tex
+	go p.SendExtensionHandshake(tf)
+	var hs extensionHandshake
+	if id := readExtended(t, remote, &hs); id != extHandshake {
+		t.Fatalf("handshake sent with id %v", id)
+	}
+	if hs.M[extTEXName] != extTEX {
+		t.Errorf("handshake m == %v, want %v: %v", hs.M, extTEXName, extTEX)
+	}
+	if hs.Tr != trackerListHash([]string{"udp://b:6969", "http://a/announce"}) {
+		t.Errorf("handshake tr == %x, want the hash of our trackers", hs.Tr)
+	}
+
+	// Once the peer's handshake arrives, we send it our trackers, under its id
+	// for lt_tex
+	b, _ := bencoding.Marshal(extensionHandshake{M: map[string]int{extTEXName: 7}})
+	errc := make(chan error, 1)
+	go func() { errc <- p.handleExtended(tf, append([]byte{extHandshake}, b...)) }()
+	var msg texMessage
+	if id := readExtended(t, remote, &msg); id != 7 {
+		t.Errorf("tex message sent with id %v, want 7", id)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Added, trackers.verified) {
+		t.Errorf("sent trackers %v, want %v", msg.Added, trackers.verified)
+	}
+
+	// Trackers the peer sends are passed on, except ones it already has and
+	// duplicates
+	b, _ = bencoding.Marshal(texMessage{Added: []string{"http://a/announce", "http://c/announce", "http://c/announce"}})
+	if err := p.handleExtended(tf, append([]byte{extTEX}, b...)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://c/announce"}; !reflect.DeepEqual(trackers.added, want) {
+		t.Errorf("added trackers %v, want %v", trackers.added, want)
+	}
+
+	// More messages within the minute are ignored
+	b, _ = bencoding.Marshal(texMessage{Added: []string{"http://d/announce"}})
+	if err := p.handleExtended(tf, append([]byte{extTEX}, b...)); err != nil {
+		t.Fatal(err)
+	}
+	if len(trackers.added) != 1 {
+		t.Errorf("added trackers %v from a message sent too soon", trackers.added)
+	}
+
+	// Nor do we send anything new until a minute's passed, and then only
+	// trackers the peer hasn't heard of
+	trackers.verified = append(trackers.verified, "http://c/announce", "http://e/announce")
+	if err := p.sendTEX(tf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	go p.sendTEX(tf, time.Now().Add(texInterval))
+	msg = texMessage{}
+	readExtended(t, remote, &msg)
+	if want := []string{"http://e/announce"}; !reflect.DeepEqual(msg.Added, want) {
+		t.Errorf("sent trackers %v, want %v", msg.Added, want)
+	}
+}
+
+func TestTEXPrivate(t *testing.T) {
+	trackers := &fakeTrackers{verified: []string{"http://a/announce"}}
+	p := &Peer{Trackers: trackers, ext: &extensionState{ids: map[string]int{extTEXName: 1}}}
+	var tf torrentfile.TorrentFile
+	tf.Info.Private = true
+
+	// With no connection, any attempt to send would panic
+	if err := p.sendTEX(tf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := bencoding.Marshal(texMessage{Added: []string{"http://b/announce"}})
+	if err := p.handleExtended(tf, append([]byte{extTEX}, b...)); err != nil {
+		t.Fatal(err)
+	}
+	if trackers.added != nil {
+		t.Errorf("added trackers %v for a private torrent", trackers.added)
+	}
+}
+
+func TestTEXSameTrackers(t *testing.T) {
+	// A peer whose handshake says it has our trackers isn't sent them
+	trackers := &fakeTrackers{verified: []string{"http://a/announce", "udp://b:6969"}}
+	p := &Peer{Trackers: trackers, ext: &extensionState{}}
+	var tf torrentfile.TorrentFile
+	b, _ := bencoding.Marshal(extensionHandshake{M: map[string]int{extTEXName: 7}, Tr: trackerListHash(trackers.verified)})
+
+	// With no connection, any attempt to send would panic
+	if err := p.handleExtended(tf, append([]byte{extHandshake}, b...)); err != nil {
+		t.Fatal(err)
+	}
+}
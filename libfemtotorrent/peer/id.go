@@ -0,0 +1,79 @@
+package peer
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// IDPrefix identifies femtotorrent and its version in peer IDs, in the
+// Azureus style: a dash, two letters for the client, four digits of version
+// and another dash.
+const IDPrefix = "-FT0001-"
+
+// An ID is the 20 byte peer id that identifies us to trackers and other peers.
+type ID [20]byte
+
+// NewID returns a random peer ID starting with IDPrefix. Each session should
+// generate one and use it for all its trackers and peers.
+func NewID() (id ID, err error) {
+	n := copy(id[:], IDPrefix)
+	_, err = rand.Read(id[n:])
+	return
+}
+
+// LoadID returns the peer ID saved in the file at path, or if there's no such
+// file, generates one with NewID and saves it there. Private trackers expect
+// a client to keep its peer ID when it reconnects, and some ban clients that
+// don't, so private torrents should use this rather than NewID.
+func LoadID(path string) (id ID, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(b) != len(id) {
+			return id, fmt.Errorf("%v: peer id is %v bytes long, want %v", path, len(b), len(id))
+		}
+		copy(id[:], b)
+		return id, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return id, err
+	}
+	id, err = NewID()
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(path, id[:], 0600)
+	return
+}
+
+func (id ID) String() string {
+	return fmt.Sprintf("%q", id[:])
+}
+
+// The ports we try to listen on, in order
+const (
+	firstPort = 6881
+	lastPort  = 6889
+)
+
+// Listen listens for incoming peer connections on the first free port from
+// 6881 to 6889, as is traditional.
+func Listen() (net.Listener, error) {
+	var err error
+	for port := firstPort; port <= lastPort; port++ {
+		var l net.Listener
+		l, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port from %v to %v: %w", firstPort, lastPort, err)
+}
@@ -0,0 +1,71 @@
+package peer
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+func TestNewID(t *testing.T) {
+	a, err := NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(a[:]), IDPrefix) {
+		t.Errorf("NewID() == %v, want prefix %q", a, IDPrefix)
+	}
+	if a == b {
+		t.Errorf("NewID() returned %v twice", a)
+	}
+}
+
+func TestLoadID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "femtotorrent", "peer-id")
+	a, err := LoadID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(a[:]), IDPrefix) {
+		t.Errorf("LoadID() == %v, want prefix %q", a, IDPrefix)
+	}
+	if a != b {
+		t.Errorf("LoadID() == %v, then %v", a, b)
+	}
+}
+
+func TestSourceAllowed(t *testing.T) {
+	var public, private torrentfile.TorrentFile
+	private.Info.Private = true
+	for _, src := range []Source{SourceTracker, SourceIncoming, SourceDHT, SourcePEX, SourceLSD, SourceTEX} {
+		if !SourceAllowed(public, src) {
+			t.Errorf("SourceAllowed(public, %v) == false", src)
+		}
+		want := src == SourceTracker || src == SourceIncoming
+		if SourceAllowed(private, src) != want {
+			t.Errorf("SourceAllowed(private, %v) == %v, want %v", src, !want, want)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	l, err := Listen()
+	if err != nil {
+		t.Skipf("no free port: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	if port < firstPort || port > lastPort {
+		t.Errorf("Listen() listened on port %v", port)
+	}
+}
@@ -2,14 +2,12 @@ package peer
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"os"
+	"time"
 
 	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
 )
@@ -21,165 +19,185 @@ type Peer struct {
 	IncomingChoked bool
 	Interested     bool // TODO: for both sides of the connection
 	conn           net.Conn
-	ID             []byte
+	ID             []byte // The remote peer's, once connected
+	LocalID        ID     // Ours, sent in the handshake
+
+	// Trackers, if set, is used to swap trackers with the peer over the
+	// extension protocol, unless the torrent is private.
+	Trackers TrackerExchange
+
+	supportsExtensions bool  // The peer set the extension bit
+	reqq               int32 // Accessed atomically; see MaxRequests
+	ext                *extensionState
 }
 
-func any(bools []bool) bool {
-	for _, b := range bools {
-		if b {
-			return true
-		}
+// Addr returns the peer's address in host:port form, with IPv6 addresses
+// bracketed as net.Dial expects.
+func (p *Peer) Addr() string {
+	return net.JoinHostPort(p.IPAddress.String(), fmt.Sprint(p.Port))
+}
+
+// Message types, the first byte of each message after the handshake
+const (
+	MsgChoke uint8 = iota
+	MsgUnchoke
+	MsgInterested
+	MsgNotInterested
+	MsgHave
+	MsgBitfield
+	MsgRequest
+	MsgPiece
+	MsgCancel
+)
+
+// BlockSize is the size of the blocks pieces are requested in. All current
+// implementations use 2^14 (16 kiB), and close connections which request an
+// amount greater than that.
+const BlockSize = 1 << 14
+
+// maxMessageLength bounds the messages we'll read: a piece message holding
+// one block, with room to spare for bitfields of very large torrents.
+const maxMessageLength = 1 << 20
+
+// handshakeTimeout is how long we wait for a peer to accept our connection,
+// and then how long we wait for the handshakes to be exchanged.
+const handshakeTimeout = 10 * time.Second
+
+// A Message is a message received from a peer, other than a keep-alive or
+// one for an extension, which are handled internally.
+type Message struct {
+	Type    uint8
+	Payload []byte
+}
+
+// Have returns the piece index from a have message.
+func (m Message) Have() (uint32, error) {
+	if m.Type != MsgHave || len(m.Payload) != 4 {
+		return 0, fmt.Errorf("invalid have message %q", m.Payload)
 	}
-	return false
+	return binary.BigEndian.Uint32(m.Payload), nil
 }
 
-func all(bools []bool) bool {
-	for _, b := range bools {
-		if !b {
-			return false
-		}
+// Bitfield returns the pieces from a bitfield message, for a torrent of n
+// pieces.
+func (m Message) Bitfield(n int) (Bitfield, error) {
+	if m.Type != MsgBitfield {
+		return nil, fmt.Errorf("message type %v is not bitfield", m.Type)
 	}
-	return true
+	return ParseBitfield(m.Payload, n)
 }
 
-func (p *Peer) Handle(tf torrentfile.TorrentFile, f *os.File) (err error) {
-	err = p.connect(tf)
+// Block returns the piece index, offset and data from a piece message.
+func (m Message) Block() (index, begin uint32, data []byte, err error) {
+	if m.Type != MsgPiece || len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("invalid piece message of %v bytes", len(m.Payload))
+	}
+	return binary.BigEndian.Uint32(m.Payload), binary.BigEndian.Uint32(m.Payload[4:]), m.Payload[8:], nil
+}
+
+// Connect dials the peer and exchanges handshakes with it. If ctx is done
+// before then, the connection is abandoned.
+func (p *Peer) Connect(ctx context.Context, tf torrentfile.TorrentFile) (err error) {
+	if p.LocalID == (ID{}) {
+		return fmt.Errorf("no local peer id set")
+	}
+	// TODO: can we also do UDP?
+	d := net.Dialer{Timeout: handshakeTimeout}
+	p.conn, err = d.DialContext(ctx, "tcp", p.Addr())
 	if err != nil {
 		return
 	}
-	const chunkSize int = 2 << 13
-	maxChunksPerPiece := (tf.Info.PieceLength + chunkSize - 1) / chunkSize
-	currentPiece := uint32(0)
-	waitingForChunkOfPiece := make([]bool, maxChunksPerPiece)
-	currentPieceBuf := make([]byte, tf.Info.PieceLength)
-	for {
-		if !p.IncomingChoked && !p.Interested {
-			log.Println("Declaring our interest")
-			p.DeclareInterested()
-		}
+	if err = p.handshake(ctx, tf, true); err != nil {
+		p.conn.Close()
+	}
+	return
+}
 
-		// Request all the fragments of this piece, if we're not currently
-		// downloading anything
-		if !p.IncomingChoked && !any(waitingForChunkOfPiece) {
-			log.Printf("Requesting piece %v/%v", currentPiece, len(tf.Info.Pieces))
-			// TODO: piece length for last piece
-			for i := 0; i < maxChunksPerPiece; i++ {
-				currentOffset := i * 2 << 13
-				remainingSize := tf.Info.PieceLength - int(currentOffset)
-				var reqLen uint32
-				if remainingSize < 2<<13 {
-					reqLen = uint32(remainingSize)
-				} else {
-					reqLen = 2 << 13
-				}
-				log.Printf("p.Request(%v, uint32(%v), %v)", currentPiece, currentOffset, reqLen)
-				p.Request(currentPiece, uint32(currentOffset), reqLen)
-				waitingForChunkOfPiece[i] = true
-			}
-		}
-		rawLen := make([]byte, 4)
-		_, err = io.ReadFull(p.conn, rawLen)
-		if err != nil {
-			return
+// Accept exchanges handshakes with a peer that connected to us, whose
+// address is taken from conn. If ctx is done before then, or the handshake
+// fails, conn is closed.
+func (p *Peer) Accept(ctx context.Context, conn net.Conn, tf torrentfile.TorrentFile) (err error) {
+	if p.LocalID == (ID{}) {
+		conn.Close()
+		return fmt.Errorf("no local peer id set")
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		p.IPAddress = addr.IP
+		p.Port = uint16(addr.Port)
+	}
+	p.conn = conn
+	if err = p.handshake(ctx, tf, false); err != nil {
+		conn.Close()
+	}
+	return
+}
+
+func (p *Peer) handshake(ctx context.Context, tf torrentfile.TorrentFile, initiator bool) (err error) {
+	p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock any read or write in progress
+			p.conn.SetDeadline(time.Now())
+		case <-stop:
 		}
-		msgLen := binary.BigEndian.Uint32(rawLen)
-		if msgLen == 0 {
-			log.Println("keepalive?")
-			continue
+	}()
+
+	// The initiator goes first
+	if initiator {
+		err = p.writeHandshake(tf)
+		if err == nil {
+			err = p.readHandshake(tf)
 		}
-		buf := make([]byte, msgLen) // TODO: don't allocate each time around
-		var n int
-		n, err = io.ReadFull(p.conn, buf)
-		if err != nil {
-			return
+	} else {
+		err = p.readHandshake(tf)
+		if err == nil {
+			err = p.writeHandshake(tf)
 		}
-		msgType := buf[0]
-		buf = buf[1:]
-		switch msgType { // message type
-		case 0:
-			log.Println("Received an incoming choke message")
-			p.IncomingChoked = true
-		case 1:
-			log.Println("Received an incoming unchoke message")
-			p.IncomingChoked = false
-		case 2:
-			log.Println("Received an incoming interested message")
-		case 3:
-			log.Println("Received an incoming uninterested message")
-		case 4:
-			piece := binary.BigEndian.Uint32(buf)
-			log.Printf("Received a have message for piece %v", piece)
-		case 5:
-			log.Printf("Received a bitfield message: %q", buf)
-		case 7: // piece
-			if n != 1+4+4+2<<13 {
-				log.Printf("Unexpected piece message size %v", n)
-			}
-			index := binary.BigEndian.Uint32(buf[:4])
-			if index != currentPiece {
-				// TODO: error?
-				log.Printf("Expecting piece %v, got piece %v", currentPiece, index)
-			}
-			begin := binary.BigEndian.Uint32(buf[4:8])
-			log.Printf("Received %v bytes of %v@%v", len(buf)-4-4, index, begin)
-
-			copy(currentPieceBuf[begin:], buf[8:])
-
-			waitingForChunkOfPiece[begin/uint32(chunkSize)] = false
-
-			if !any(waitingForChunkOfPiece) {
-				checksum := sha1.Sum(currentPieceBuf)
-				if !bytes.Equal(checksum[:], tf.Info.Pieces[index]) {
-					return fmt.Errorf("Invalid checksum for piece %v: %v (expected %v)", index, hex.EncodeToString(checksum[:]), hex.EncodeToString(tf.Info.Pieces[index]))
-				}
-				p.Have(uint32(index))
-				n, err := f.Write(currentPieceBuf) // TODO: shorter last chunk?
-				if err != nil {
-					return err
-				}
-				if n != len(currentPieceBuf) {
-					return fmt.Errorf("Tried to write %v bytes to %v, only wrote %v", len(currentPieceBuf), f.Name(), n)
-				}
-				log.Printf("Completed piece %v/%v", currentPiece, len(tf.Info.Pieces))
-				// advance to the next piece
-				currentPiece++
-				if int(currentPiece) == len(tf.Info.Pieces) {
-					log.Println("Download complete!")
-					return nil
-				}
-			}
-		default:
-			log.Printf("In loop, received %v bytes: %q", len(buf), buf)
+	}
+	if err == nil && p.supportsExtensions {
+		p.ext = &extensionState{}
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
 		}
+		return
 	}
+	return p.conn.SetDeadline(time.Time{})
+}
+
+// Close closes the connection to the peer.
+func (p *Peer) Close() error {
+	return p.conn.Close()
 }
 
-func (p *Peer) connect(tf torrentfile.TorrentFile) (err error) {
+func (p *Peer) writeHandshake(tf torrentfile.TorrentFile) error {
 	// Connections start out choked and not interested.
 	p.IncomingChoked = true
 	p.OutgoingChoked = true
 	p.Interested = false
 
-	// TODO: can we also do UDP?
-	p.conn, err = net.Dial("tcp", net.JoinHostPort(p.IPAddress.String(), fmt.Sprint(p.Port)))
-	if err != nil {
-		return
-	}
-
 	// The peer wire protocol consists of a handshake followed by a never-ending
 	// stream of length-prefixed messages. The handshake starts with character
 	// ninteen (decimal) followed by the string 'BitTorrent protocol'. The
 	// leading character is a length prefix, put there in the hope that other
 	// new protocols may do the same and thus be trivially distinguishable from
 	// each other.
-	p.conn.Write([]byte{19})
-	p.conn.Write([]byte("BitTorrent protocol"))
+	buf := []byte("\x13BitTorrent protocol")
 
 	// After the fixed headers come eight reserved bytes, which are all zero in
 	// all current implementations. If you wish to extend the protocol using
 	// these bytes, please coordinate with Bram Cohen to make sure all
 	// extensions are done compatibly.
-	p.conn.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0})
+	//
+	// (They did not all stay zero: we set the bit for the extension protocol
+	// of BEP 10.)
+	reserved := make([]byte, 8)
+	reserved[extensionByte] |= extensionBit
+	buf = append(buf, reserved...)
 
 	// Next comes the 20 byte sha1 hash of the bencoded form of the info value
 	// from the metainfo file. (This is the same value which is announced as
@@ -188,17 +206,23 @@ func (p *Peer) connect(tf torrentfile.TorrentFile) (err error) {
 	// possible exception is if a downloader wants to do multiple downloads over
 	// a single port, they may wait for incoming connections to give a download
 	// hash first, and respond with the same one if it's in their list.
-	p.conn.Write(tf.InfoHash[:])
+	buf = append(buf, tf.InfoHash[:]...)
 
 	// After the download hash comes the 20-byte peer id which is reported in
 	// tracker requests and contained in peer lists in tracker responses. If the
 	// receiving side's peer id doesn't match the one the initiating side
 	// expects, it severs the connection.
-	p.conn.Write([]byte("chandlerswiftdebian!"))
+	buf = append(buf, p.LocalID[:]...)
 
-	buf := make([]byte, 65536)
-	var n int
-	n, err = p.conn.Read(buf)
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+func (p *Peer) readHandshake(tf torrentfile.TorrentFile) (err error) {
+	// The peer may send more messages straight after its handshake, so we
+	// must read exactly the handshake's length.
+	buf := make([]byte, 68)
+	_, err = io.ReadFull(p.conn, buf)
 	if err != nil {
 		return
 	}
@@ -211,29 +235,67 @@ func (p *Peer) connect(tf torrentfile.TorrentFile) (err error) {
 	// TODO: validate against what we expect
 	p.ID = buf[48:68]
 
-	if n > 68 {
-		// we got more bytes than we know what to do with
-		return fmt.Errorf("Too many bytes! Expected 68, got %v", n)
-	}
-
+	p.supportsExtensions = buf[20+extensionByte]&extensionBit != 0
 	return
 }
 
+// ReadMessage reads the next message from the peer. Keep-alives and
+// extension messages are dealt with here and not returned. Choke and unchoke
+// messages update IncomingChoked before they're returned.
+func (p *Peer) ReadMessage(tf torrentfile.TorrentFile) (msg Message, err error) {
+	rawLen := make([]byte, 4)
+	for {
+		if err = p.sendTEX(tf, time.Now()); err != nil {
+			return
+		}
+		_, err = io.ReadFull(p.conn, rawLen)
+		if err != nil {
+			return
+		}
+		msgLen := binary.BigEndian.Uint32(rawLen)
+		if msgLen == 0 {
+			continue // keep-alive
+		}
+		if msgLen > maxMessageLength {
+			return msg, fmt.Errorf("message of %v bytes is too long", msgLen)
+		}
+		buf := make([]byte, msgLen)
+		_, err = io.ReadFull(p.conn, buf)
+		if err != nil {
+			return
+		}
+		msg = Message{Type: buf[0], Payload: buf[1:]}
+		switch msg.Type {
+		case MsgChoke:
+			p.IncomingChoked = true
+		case MsgUnchoke:
+			p.IncomingChoked = false
+		case msgExtended:
+			if err = p.handleExtended(tf, msg.Payload); err != nil {
+				return
+			}
+			continue
+		}
+		return
+	}
+}
+
 func (p *Peer) Choke() {
-	p.conn.Write([]byte{0, 0, 0, 1, 0})
+	p.conn.Write([]byte{0, 0, 0, 1, MsgChoke})
 }
 
 func (p *Peer) Unchoke() {
-	p.conn.Write([]byte{0, 0, 0, 1, 1})
+	p.conn.Write([]byte{0, 0, 0, 1, MsgUnchoke})
 }
 
 func (p *Peer) DeclareInterested() {
-	p.conn.Write([]byte{0, 0, 0, 1, 2})
+	p.conn.Write([]byte{0, 0, 0, 1, MsgInterested})
 	p.Interested = true
 }
 
 func (p *Peer) DeclareNotInterested() {
-	p.conn.Write([]byte{0, 0, 0, 1, 3})
+	p.conn.Write([]byte{0, 0, 0, 1, MsgNotInterested})
+	p.Interested = false
 }
 
 func (p *Peer) Have(index uint32) error {
@@ -243,22 +305,27 @@ func (p *Peer) Have(index uint32) error {
 		Index        uint32
 	}{
 		LengthPrefix: 1 + 4,
-		MessageType:  4,
+		MessageType:  MsgHave,
 		Index:        index,
 	}
 
 	return binary.Write(p.conn, binary.BigEndian, msg)
 }
 
-func (p *Peer) Bitfield() {
-	panic("unimplemented") // TODO
-	p.conn.Write([]byte{5})
+// 'bitfield' is only ever sent as the first message, and is optional: a
+// downloader which has nothing needn't send it. Its payload has a bit for
+// each piece, set if the sender has that piece.
+func (p *Peer) Bitfield(b Bitfield) error {
+	msg := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(1+len(b)))
+	msg[4] = MsgBitfield
+	_, err := p.conn.Write(append(msg, b...))
+	return err
 }
 
 // 'request' messages contain an index, begin, and length. The last two are byte
 // offsets. Length is generally a power of two unless it gets truncated by the
-// end of the file. All current implementations use 2^14 (16 kiB), and close
-// connections which request an amount greater than that.
+// end of the file; see BlockSize.
 func (p *Peer) Request(index, begin, length uint32) error {
 	msg := struct {
 		LengthPrefix uint32
@@ -268,7 +335,7 @@ func (p *Peer) Request(index, begin, length uint32) error {
 		Length       uint32
 	}{
 		LengthPrefix: 1 + 4 + 4 + 4,
-		MessageType:  6,
+		MessageType:  MsgRequest,
 		Index:        index,
 		Begin:        begin,
 		Length:       length,
@@ -282,7 +349,29 @@ func (p *Peer) Piece() {
 	panic("unimplemented") // TODO
 }
 
-func (p *Peer) Cancel() {
-	p.conn.Write([]byte{8})
-	panic("unimplemented") // TODO
+// 'cancel' messages have the same payload as request messages. They are
+// generally only sent towards the end of a download, during what's called
+// 'endgame mode'. When a download is almost complete, there's a tendency for
+// the last few pieces to all be downloaded off a single hosed modem line,
+// taking a very long time. To make sure the last few pieces come in quickly,
+// once requests for all pieces a given downloader doesn't have yet are
+// currently pending, it sends requests for everything to everyone it's
+// downloading from. To keep this from becoming horribly inefficient, it sends
+// cancels to everyone else every time a piece arrives.
+func (p *Peer) Cancel(index, begin, length uint32) error {
+	msg := struct {
+		LengthPrefix uint32
+		MessageType  uint8
+		Index        uint32
+		Begin        uint32
+		Length       uint32
+	}{
+		LengthPrefix: 1 + 4 + 4 + 4,
+		MessageType:  MsgCancel,
+		Index:        index,
+		Begin:        begin,
+		Length:       length,
+	}
+
+	return binary.Write(p.conn, binary.BigEndian, msg)
 }
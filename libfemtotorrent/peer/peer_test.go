@@ -0,0 +1,77 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+func TestWriteMessages(t *testing.T) {
+	cases := []struct {
+		send func(p *Peer) error
+		want []byte
+	}{
+		{func(p *Peer) error { return p.Have(7) }, []byte{0, 0, 0, 5, MsgHave, 0, 0, 0, 7}},
+		{func(p *Peer) error { return p.Request(1, 2, 3) }, []byte{0, 0, 0, 13, MsgRequest, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+		{func(p *Peer) error { return p.Cancel(1, 2, 3) }, []byte{0, 0, 0, 13, MsgCancel, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+		{func(p *Peer) error { return p.Bitfield(Bitfield{0xa0, 0x80}) }, []byte{0, 0, 0, 3, MsgBitfield, 0xa0, 0x80}},
+	}
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		p := &Peer{conn: local}
+		errc := make(chan error, 1)
+		go func() { errc <- c.send(p) }()
+		got := make([]byte, len(c.want))
+		if _, err := io.ReadFull(remote, got); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("sent %v, want %v", got, c.want)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go remote.Write([]byte{
+		0, 0, 0, 0, // Keep-alive
+		0, 0, 0, 1, MsgUnchoke,
+		0, 0, 0, 5, MsgHave, 0, 0, 1, 0,
+		0, 0, 0, 12, MsgPiece, 0, 0, 0, 2, 0, 0, 0x40, 0, 'a', 'b', 'c',
+	})
+	p := &Peer{conn: local, IncomingChoked: true}
+	var tf torrentfile.TorrentFile
+
+	msg, err := p.ReadMessage(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MsgUnchoke || p.IncomingChoked {
+		t.Errorf("read %v, IncomingChoked %v; want an unchoke", msg, p.IncomingChoked)
+	}
+	msg, err = p.ReadMessage(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, err := msg.Have(); err != nil || i != 256 {
+		t.Errorf("read have for %v, %v; want 256", i, err)
+	}
+	msg, err = p.ReadMessage(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, begin, data, err := msg.Block()
+	if err != nil || index != 2 || begin != BlockSize || string(data) != "abc" {
+		t.Errorf("read block %v@%v %q, %v; want 2@%v \"abc\"", index, begin, data, err, BlockSize)
+	}
+}
@@ -0,0 +1,44 @@
+package peer
+
+import "github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+
+// A Source is somewhere we can learn about peers from.
+type Source int
+
+const (
+	SourceTracker  Source = iota // The torrent's own trackers
+	SourceIncoming               // Peers that connect to us
+	SourceDHT                    // The distributed hash table, BEP 5
+	SourcePEX                    // Peer exchange, BEP 11
+	SourceLSD                    // Local service discovery, BEP 14
+	SourceTEX                    // Trackers learned from peers, BEP 28
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceIncoming:
+		return "incoming"
+	case SourceDHT:
+		return "DHT"
+	case SourcePEX:
+		return "PEX"
+	case SourceLSD:
+		return "LSD"
+	case SourceTEX:
+		return "TEX"
+	}
+	return "unknown"
+}
+
+// SourceAllowed reports whether peers for tf may come from src. Private
+// torrents (BEP 27) may only use their own trackers and the peers those
+// trackers send our way; anything that could leak the swarm, or let in peers
+// the tracker doesn't know of, is off.
+func SourceAllowed(tf torrentfile.TorrentFile, src Source) bool {
+	if !tf.Info.Private {
+		return true
+	}
+	return src == SourceTracker || src == SourceIncoming
+}
@@ -0,0 +1,566 @@
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+)
+
+// A conn is the Swarm's view of one peer. Apart from addr and p, its fields
+// are guarded by the Swarm's mu.
+type conn struct {
+	addr   string
+	p      *peer.Peer
+	ready  bool          // Handshakes are done, so we can send messages
+	choked bool          // The peer is choking us
+	has    peer.Bitfield // The pieces the peer has told us it has
+	kick   chan struct{} // Poked when there may be more to request
+
+	pieces   []*piece  // The pieces we're requesting blocks of from the peer
+	requests []request // Outstanding, oldest first
+
+	// snubbed is set when a request times out, and cleared when a block
+	// arrives. Other peers get the first chance to take over its pieces:
+	// we ask it for nothing for another timeout, and then for only one
+	// block at a time.
+	snubbed   bool
+	snubbedAt time.Time
+
+	// The peer's throughput in bytes per second, averaged over the last few
+	// rateWindows, and what's arrived in the current window
+	rate         float64
+	rateStart    time.Time
+	rateReceived int
+}
+
+type request struct {
+	pc    *piece
+	block int
+	sent  time.Time
+}
+
+type blockState uint8
+
+const (
+	blockWanted blockState = iota
+	blockRequested
+	blockReceived
+)
+
+type block struct {
+	state blockState
+	from  []*conn // Who it's requested from; more than one in endgame
+}
+
+// A piece is being downloaded. Its blocks are requested from its owner, and
+// once the owner chokes us or goes away, it's left with no owner until
+// another peer takes it on.
+type piece struct {
+	index     uint32
+	buf       []byte
+	blocks    []block
+	received  int
+	owner     *conn
+	verifying bool // Every block is here, and the hash is being checked
+}
+
+func newPiece(index uint32, length int) *piece {
+	return &piece{
+		index:  index,
+		buf:    make([]byte, length),
+		blocks: make([]block, (length+peer.BlockSize-1)/peer.BlockSize),
+	}
+}
+
+// blockLength returns the length of block b; the last may be short.
+func (pc *piece) blockLength(b int) int {
+	if rem := len(pc.buf) - b*peer.BlockSize; rem < peer.BlockSize {
+		return rem
+	}
+	return peer.BlockSize
+}
+
+// serve downloads from c, a connected peer, until it goes away or ctx is
+// done.
+func (s *Swarm) serve(ctx context.Context, c *conn) {
+	defer s.drop(c)
+	defer c.p.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.p.Close()
+		case <-stop:
+		}
+	}()
+
+	if err := s.announce(c); err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Dropping %v: %v", c.addr, err)
+		}
+		return
+	}
+
+	// Messages are read on their own goroutine, so we can be kicked while
+	// waiting for them. It's only started now, as the replies to some
+	// messages mustn't go before the bitfield.
+	msgs := make(chan peer.Message)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := c.p.ReadMessage(s.tf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	if err := s.download(c, msgs, errc); err != nil && ctx.Err() == nil {
+		log.Printf("Dropping %v: %v", c.addr, err)
+	}
+}
+
+// announce tells c which pieces we have, with a bitfield message if we have
+// any, followed by our extension handshake, then marks it ready to be told of pieces as they're verified. Pieces
+// verified while the bitfield was being sent, or left out of it to make a
+// lazy bitfield, are sent as have messages.
+func (s *Swarm) announce(c *conn) error {
+	s.mu.Lock()
+	sent := peer.NewBitfield(len(s.have))
+	for i, have := range s.have {
+		if have {
+			sent.Set(i)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.LazyBitfield {
+		withheld := 0
+		for _, i := range rand.Perm(len(s.have)) {
+			if withheld == lazyHaves {
+				break
+			}
+			if sent.Has(i) {
+				sent.Clear(i)
+				withheld++
+			}
+		}
+	}
+	if sent.Count() > 0 {
+		if err := c.p.Bitfield(sent); err != nil {
+			return err
+		}
+	}
+	if err := c.p.SendExtensionHandshake(s.tf); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	c.ready = true
+	var haves []uint32
+	for i, have := range s.have {
+		if have && !sent.Has(i) {
+			haves = append(haves, uint32(i))
+		}
+	}
+	s.mu.Unlock()
+	for _, i := range haves {
+		if err := c.p.Have(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Swarm) download(c *conn, msgs <-chan peer.Message, errc <-chan error) error {
+	// Often enough to notice stalled requests soon after they time out
+	timeout := s.requestTimeout()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		if err := s.request(c); err != nil {
+			return err
+		}
+		var msg peer.Message
+		select {
+		case msg = <-msgs:
+		case err := <-errc:
+			return err
+		case <-c.kick:
+			continue
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if len(c.requests) > 0 && now.Sub(c.requests[0].sent) > timeout {
+				log.Printf("Requests to %v timed out", c.addr)
+				c.snubbed = true
+				c.snubbedAt = now
+				s.release(c)
+			}
+			s.mu.Unlock()
+			// For peers that send us too little to prompt it otherwise
+			if err := c.p.SendTrackers(s.tf); err != nil {
+				return err
+			}
+			continue
+		}
+		switch msg.Type {
+		case peer.MsgChoke:
+			// Any requests outstanding are discarded
+			s.mu.Lock()
+			c.choked = true
+			s.release(c)
+			s.mu.Unlock()
+		case peer.MsgUnchoke:
+			s.mu.Lock()
+			c.choked = false
+			s.mu.Unlock()
+		case peer.MsgHave:
+			i, err := msg.Have()
+			if err != nil {
+				return err
+			}
+			if int(i) >= len(s.have) {
+				return fmt.Errorf("have message for piece %v of %v", i, len(s.have))
+			}
+			s.mu.Lock()
+			s.setHas(c, int(i), true)
+			s.mu.Unlock()
+		case peer.MsgBitfield:
+			has, err := msg.Bitfield(len(s.have))
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			for i := range s.have {
+				s.setHas(c, i, has.Has(i))
+			}
+			s.mu.Unlock()
+		case peer.MsgPiece:
+			if err := s.receive(c, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// interesting reports whether c has any piece we don't. Called with mu held.
+func (s *Swarm) interesting(c *conn) bool {
+	for i, have := range s.have {
+		if !have && c.has.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHas records whether c has piece i. Called with mu held.
+func (s *Swarm) setHas(c *conn, i int, has bool) {
+	if c.has.Has(i) == has {
+		return
+	}
+	if has {
+		c.has.Set(i)
+		s.available[i]++
+	} else {
+		c.has.Clear(i)
+		s.available[i]--
+	}
+}
+
+// pick chooses a new piece for c to send us: one another peer started on, if
+// there is one, and otherwise whichever the Picker chooses. Called with mu
+// held.
+func (s *Swarm) pick(c *conn) *piece {
+	for _, pc := range s.pieces {
+		if pc.owner == nil && !pc.verifying && c.has.Has(int(pc.index)) {
+			return pc
+		}
+	}
+	i, ok := s.Picker.Pick(Pieces{Have: s.have, Availability: s.available}, func(i int) bool {
+		return c.has.Has(i) && !s.have[i] && s.pieces[uint32(i)] == nil
+	})
+	if !ok {
+		return nil
+	}
+	pc := newPiece(uint32(i), int(s.tf.Info.PieceSize(i)))
+	s.pieces[pc.index] = pc
+	return pc
+}
+
+// queueDepth returns how many requests to keep outstanding with c: enough
+// to cover queueTime at its measured rate, within the configured bounds and
+// the number the peer said it would queue. Called with mu held.
+func (s *Swarm) queueDepth(c *conn) int {
+	if c.snubbed {
+		return 1
+	}
+	depth := s.QueueDepth
+	if depth <= 0 {
+		depth = DefaultQueueDepth
+	}
+	if d := int(c.rate * queueTime.Seconds() / peer.BlockSize); d > depth {
+		depth = d
+	}
+	max := s.MaxQueueDepth
+	if max <= 0 {
+		max = DefaultMaxQueueDepth
+	}
+	if reqq := c.p.MaxRequests(); reqq > 0 && reqq < max {
+		max = reqq
+	}
+	if depth > max {
+		depth = max
+	}
+	return depth
+}
+
+// nextBlock returns a block to request from c, from the pieces it's sending
+// us, or if they're all requested, from a new piece. Called with mu held.
+func (s *Swarm) nextBlock(c *conn) (*piece, int) {
+	for _, pc := range c.pieces {
+		for b := range pc.blocks {
+			if pc.blocks[b].state == blockWanted {
+				return pc, b
+			}
+		}
+	}
+	pc := s.pick(c)
+	if pc == nil {
+		return nil, 0
+	}
+	pc.owner = c
+	c.pieces = append(c.pieces, pc)
+	for b := range pc.blocks {
+		if pc.blocks[b].state == blockWanted {
+			return pc, b
+		}
+	}
+	// Can't happen: a piece whose blocks are all requested has an owner
+	return nil, 0
+}
+
+// endgameBlock returns a block to request from c that's already requested
+// from another peer, if we're in endgame: every block we don't have is
+// requested from someone, so rather than wait on the slowest of them we ask
+// several. Those with fewest requests are chosen first. Called with mu held.
+func (s *Swarm) endgameBlock(c *conn) (*piece, int) {
+	started := 0
+	for _, pc := range s.pieces {
+		started++
+		for b := range pc.blocks {
+			if pc.blocks[b].state == blockWanted {
+				return nil, 0
+			}
+		}
+	}
+	if s.nHave+started < len(s.have) {
+		return nil, 0
+	}
+
+	var best *piece
+	bestBlock := 0
+	for _, pc := range s.pieces {
+		if pc.verifying || !c.has.Has(int(pc.index)) {
+			continue
+		}
+	blocks:
+		for b := range pc.blocks {
+			blk := pc.blocks[b]
+			if blk.state != blockRequested {
+				continue
+			}
+			for _, from := range blk.from {
+				if from == c {
+					continue blocks
+				}
+			}
+			if best == nil || len(blk.from) < len(best.blocks[bestBlock].from) {
+				best, bestBlock = pc, b
+			}
+		}
+	}
+	return best, bestBlock
+}
+
+// request tells c whether we're interested, and if it's not choking us,
+// tops up the requests outstanding with it.
+func (s *Swarm) request(c *conn) error {
+	s.mu.Lock()
+	interesting := s.interesting(c)
+	var reqs []request
+	now := time.Now()
+	coolingOff := c.snubbed && now.Sub(c.snubbedAt) < s.requestTimeout()
+	if interesting && !c.choked && !coolingOff {
+		for depth := s.queueDepth(c); len(c.requests) < depth; {
+			pc, b := s.nextBlock(c)
+			if pc == nil {
+				pc, b = s.endgameBlock(c)
+			}
+			if pc == nil {
+				break
+			}
+			pc.blocks[b].state = blockRequested
+			pc.blocks[b].from = append(pc.blocks[b].from, c)
+			r := request{pc: pc, block: b, sent: now}
+			c.requests = append(c.requests, r)
+			reqs = append(reqs, r)
+		}
+		if len(reqs) > 0 && c.rateStart.IsZero() {
+			c.rateStart = now
+		}
+	}
+	s.mu.Unlock()
+
+	if interesting && !c.p.Interested {
+		c.p.DeclareInterested()
+	} else if !interesting && c.p.Interested {
+		c.p.DeclareNotInterested()
+	}
+	for _, r := range reqs {
+		if err := c.p.Request(r.pc.index, uint32(r.block*peer.BlockSize), uint32(r.pc.blockLength(r.block))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive stores a block from c, and once its piece is complete, verifies it.
+// A block that was requested from another peer, or that we'd given up on, is
+// still used if we don't have it yet.
+func (s *Swarm) receive(c *conn, msg peer.Message) error {
+	index, begin, data, err := msg.Block()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	pc := s.pieces[index]
+	b := int(begin / peer.BlockSize)
+	if pc == nil || begin%peer.BlockSize != 0 || b >= len(pc.blocks) || pc.blocks[b].state == blockReceived {
+		// Most likely it was requested from more than one peer in
+		// endgame, and the other got here first
+		s.duplicate += int64(len(data))
+		s.mu.Unlock()
+		return nil
+	}
+	if len(data) != pc.blockLength(b) {
+		s.mu.Unlock()
+		return fmt.Errorf("block %v@%v is %v bytes, want %v", index, begin, len(data), pc.blockLength(b))
+	}
+	var cancel []*peer.Peer
+	for _, from := range pc.blocks[b].from {
+		from.removeRequest(pc, b)
+		if from != c {
+			cancel = append(cancel, from.p)
+		}
+	}
+	copy(pc.buf[begin:], data)
+	pc.blocks[b] = block{state: blockReceived}
+	pc.received++
+	c.snubbed = false
+	c.measure(len(data), time.Now())
+
+	complete := pc.received == len(pc.blocks)
+	if complete {
+		pc.verifying = true
+		if pc.owner != nil {
+			pc.owner.removePiece(pc)
+			pc.owner = nil
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range cancel {
+		p.Cancel(index, begin, uint32(len(data)))
+	}
+	if complete {
+		return s.verify(c, pc)
+	}
+	return nil
+}
+
+// measure accounts for n bytes arriving from c.
+func (c *conn) measure(n int, now time.Time) {
+	if c.rateStart.IsZero() {
+		// Requested before the window was reset
+		c.rateStart = now
+		return
+	}
+	c.rateReceived += n
+	elapsed := now.Sub(c.rateStart)
+	if elapsed < rateWindow {
+		return
+	}
+	sample := float64(c.rateReceived) / elapsed.Seconds()
+	if c.rate == 0 {
+		c.rate = sample
+	} else {
+		c.rate = (c.rate + sample) / 2
+	}
+	c.rateStart = now
+	c.rateReceived = 0
+}
+
+func (c *conn) removeRequest(pc *piece, b int) {
+	for i, r := range c.requests {
+		if r.pc == pc && r.block == b {
+			c.requests = append(c.requests[:i], c.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *conn) removePiece(pc *piece) {
+	for i, p := range c.pieces {
+		if p == pc {
+			c.pieces = append(c.pieces[:i], c.pieces[i+1:]...)
+			return
+		}
+	}
+}
+
+// release forgets the requests outstanding with c, and hands back the pieces
+// it was sending us for other peers to finish. Called with mu held.
+func (s *Swarm) release(c *conn) {
+	if len(c.pieces) == 0 && len(c.requests) == 0 {
+		return
+	}
+	for _, r := range c.requests {
+		blk := &r.pc.blocks[r.block]
+		for i, from := range blk.from {
+			if from == c {
+				blk.from = append(blk.from[:i], blk.from[i+1:]...)
+				break
+			}
+		}
+		if len(blk.from) == 0 {
+			blk.state = blockWanted
+		}
+	}
+	c.requests = nil
+	for _, pc := range c.pieces {
+		pc.owner = nil
+	}
+	c.pieces = nil
+	// Time spent waiting for a peer that's choking us isn't its throughput
+	c.rateStart = time.Time{}
+	c.rateReceived = 0
+	for _, other := range s.conns {
+		if other != c {
+			select {
+			case other.kick <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
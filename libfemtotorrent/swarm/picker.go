@@ -0,0 +1,123 @@
+package swarm
+
+import "math/rand"
+
+// Pieces describes a download's progress, for a PiecePicker.
+type Pieces struct {
+	Have         []bool // The pieces we've verified
+	Availability []int  // How many of our peers have each piece
+}
+
+// A PiecePicker chooses the next piece to download from a peer.
+type PiecePicker interface {
+	// Pick returns a piece for which candidate returns true, which it does
+	// for pieces the peer has that we neither have nor are downloading from
+	// anyone else. It returns false if there are no candidates.
+	Pick(p Pieces, candidate func(i int) bool) (int, bool)
+}
+
+// Sequential picks pieces in order, which suits streaming media but does
+// little for the swarm.
+type Sequential struct{}
+
+func (Sequential) Pick(p Pieces, candidate func(i int) bool) (int, bool) {
+	for i := range p.Have {
+		if candidate(i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// DefaultRandomFirst is how many pieces NewRarestFirst's picker chooses at
+// random before it starts picking the rarest.
+const DefaultRandomFirst = 4
+
+// RarestFirst picks the piece fewest of our peers have, so pieces that might
+// disappear from the swarm are copied first, and the pieces we have are ones
+// our peers are likely to want. Ties are broken at random.
+//
+// Until we have RandomFirst pieces, it picks at random instead: the rarest
+// pieces are slow to get, as few peers can send them, and until we have a
+// piece or two there's nothing we can offer peers in return.
+type RarestFirst struct {
+	RandomFirst int
+	Rand        *rand.Rand // If nil, the math/rand functions are used
+}
+
+// NewRarestFirst returns a RarestFirst picker that picks its first
+// DefaultRandomFirst pieces at random.
+func NewRarestFirst() *RarestFirst {
+	return &RarestFirst{RandomFirst: DefaultRandomFirst}
+}
+
+func (r *RarestFirst) intn(n int) int {
+	if r.Rand != nil {
+		return r.Rand.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+func (r *RarestFirst) Pick(p Pieces, candidate func(i int) bool) (int, bool) {
+	have := 0
+	for _, h := range p.Have {
+		if h {
+			have++
+		}
+	}
+	random := have < r.RandomFirst
+
+	// Reservoir sampling, so ties are broken uniformly without building a
+	// list of them
+	picked, ties := -1, 0
+	for i := range p.Have {
+		if !candidate(i) {
+			continue
+		}
+		if !random && picked >= 0 && p.Availability[i] > p.Availability[picked] {
+			continue
+		}
+		if !random && picked >= 0 && p.Availability[i] < p.Availability[picked] {
+			ties = 0
+		}
+		ties++
+		if r.intn(ties) == 0 {
+			picked = i
+		}
+	}
+	return picked, picked >= 0
+}
+
+// Prioritized picks the pieces with the highest priority first, such as
+// those in files the user wants soonest, leaving Picker to choose between
+// pieces of equal priority.
+type Prioritized struct {
+	Priorities []int       // By piece; pieces past its end have priority 0
+	Picker     PiecePicker // If nil, NewRarestFirst's picker is used
+}
+
+func (pr *Prioritized) priority(i int) int {
+	if i < len(pr.Priorities) {
+		return pr.Priorities[i]
+	}
+	return 0
+}
+
+func (pr *Prioritized) Pick(p Pieces, candidate func(i int) bool) (int, bool) {
+	best, found := 0, false
+	for i := range p.Have {
+		if candidate(i) && (!found || pr.priority(i) > best) {
+			best, found = pr.priority(i), true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	picker := pr.Picker
+	if picker == nil {
+		picker = NewRarestFirst()
+	}
+	return picker.Pick(p, func(i int) bool {
+		return candidate(i) && pr.priority(i) == best
+	})
+}
@@ -0,0 +1,151 @@
+package swarm
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// pieces builds a Pieces from a string, one character per piece: '*' for a
+// piece we have, or a digit for how many peers have it.
+func pieces(s string) Pieces {
+	p := Pieces{Have: make([]bool, len(s)), Availability: make([]int, len(s))}
+	for i, c := range s {
+		if c == '*' {
+			p.Have[i] = true
+		} else {
+			p.Availability[i] = int(c - '0')
+		}
+	}
+	return p
+}
+
+// peerHas returns a candidate function for a peer with the pieces marked 'x'.
+func peerHas(p Pieces, has string) func(int) bool {
+	return func(i int) bool {
+		return !p.Have[i] && has[i] == 'x'
+	}
+}
+
+func TestSequential(t *testing.T) {
+	cases := []struct {
+		pieces, has string
+		want        int
+	}{
+		{"1111", "xxxx", 0},
+		{"**11", "xxxx", 2},
+		{"1111", ".x.x", 1},
+		{"**11", "xx..", -1},
+	}
+	for _, c := range cases {
+		p := pieces(c.pieces)
+		got, ok := Sequential{}.Pick(p, peerHas(p, c.has))
+		if !ok {
+			got = -1
+		}
+		if got != c.want {
+			t.Errorf("Sequential.Pick(%q, %q) == %v, want %v", c.pieces, c.has, got, c.want)
+		}
+	}
+}
+
+func TestRarestFirst(t *testing.T) {
+	cases := []struct {
+		pieces, has string
+		want        []int // Any of these
+	}{
+		{"****3214", "xxxxxxxx", []int{6}},
+		{"****3214", "xxxxxx.x", []int{5}},
+		{"****2324", "xxxxxxxx", []int{4, 6}},
+		{"****", "xxxx", nil},
+	}
+	r := &RarestFirst{RandomFirst: 4, Rand: rand.New(rand.NewSource(1))}
+	for _, c := range cases {
+		p := pieces(c.pieces)
+		for n := 0; n < 20; n++ {
+			got, ok := r.Pick(p, peerHas(p, c.has))
+			if !ok {
+				if c.want != nil {
+					t.Errorf("RarestFirst.Pick(%q, %q) found nothing", c.pieces, c.has)
+				}
+				break
+			}
+			if !contains(c.want, got) {
+				t.Errorf("RarestFirst.Pick(%q, %q) == %v, want one of %v", c.pieces, c.has, got, c.want)
+			}
+		}
+	}
+}
+
+func TestRarestFirstTies(t *testing.T) {
+	r := &RarestFirst{Rand: rand.New(rand.NewSource(1))}
+	p := pieces("2131111")
+	counts := make(map[int]int)
+	for n := 0; n < 1000; n++ {
+		i, _ := r.Pick(p, peerHas(p, "xxxxxxx"))
+		counts[i]++
+	}
+	for _, i := range []int{1, 3, 4, 5, 6} {
+		if counts[i] < 100 {
+			t.Errorf("piece %v picked %v times out of 1000", i, counts[i])
+		}
+	}
+	if counts[0]+counts[2] != 0 {
+		t.Errorf("common pieces picked: %v", counts)
+	}
+}
+
+func TestRarestFirstRandomStart(t *testing.T) {
+	r := &RarestFirst{RandomFirst: 2, Rand: rand.New(rand.NewSource(1))}
+	p := pieces("*9999991")
+	picked := make(map[int]bool)
+	for n := 0; n < 100; n++ {
+		i, _ := r.Pick(p, peerHas(p, "xxxxxxxx"))
+		picked[i] = true
+	}
+	if len(picked) < 3 {
+		t.Errorf("with one piece, picked only %v", picked)
+	}
+
+	// Once we have enough pieces, only the rarest is picked
+	p = pieces("**999991")
+	for n := 0; n < 100; n++ {
+		if i, _ := r.Pick(p, peerHas(p, "xxxxxxxx")); i != 7 {
+			t.Fatalf("with two pieces, picked %v, want 7", i)
+		}
+	}
+}
+
+func TestPrioritized(t *testing.T) {
+	pr := &Prioritized{Priorities: []int{1, 1, 5, 5, 5, 1}, Picker: Sequential{}}
+	cases := []struct {
+		pieces, has string
+		want        int
+	}{
+		{"11111111", "xxxxxxxx", 2},
+		{"11*1*111", "xxxxxxxx", 3},
+		{"11***111", "xxxxxxxx", 0},
+		// Pieces past the end of Priorities come last
+		{"*****111", "xxxxxxxx", 5},
+		{"******11", "xxxxxxxx", 6},
+		{"11111111", "xx.....x", 0},
+	}
+	for _, c := range cases {
+		p := pieces(c.pieces)
+		got, ok := pr.Pick(p, peerHas(p, c.has))
+		if !ok {
+			got = -1
+		}
+		if got != c.want {
+			t.Errorf("Prioritized.Pick(%q, %q) == %v, want %v", c.pieces, c.has, got, c.want)
+		}
+	}
+}
+
+func contains(ints []int, i int) bool {
+	for _, j := range ints {
+		if i == j {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+// Package swarm downloads a torrent from many peers at once.
+//
+// A Swarm connects to the peers it's given, up to a limit, and downloads
+// different pieces from each of them. Which pieces are wanted, being
+// downloaded, or done is shared between all the connections, so when a peer
+// chokes us or goes away the piece it was sending us is handed to another
+// peer, which carries on from the blocks that already arrived.
+package swarm
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// Defaults for the Swarm's settings
+const (
+	DefaultMaxPeers       = 30
+	DefaultQueueDepth     = 5
+	DefaultMaxQueueDepth  = 250
+	DefaultRequestTimeout = 30 * time.Second
+)
+
+const (
+	// queueTime is how long we'd like each peer's outstanding requests to
+	// keep it busy for, so it always has the next block to send.
+	queueTime = 3 * time.Second
+
+	// rateWindow is how often a peer's throughput is sampled.
+	rateWindow = time.Second
+
+	// lazyHaves is how many pieces a lazy bitfield leaves out.
+	lazyHaves = 4
+)
+
+// A Swarm downloads a torrent, writing verified pieces to its storage.
+type Swarm struct {
+	// MaxPeers is the most peers to be connected to at once, counting
+	// those that connected to us. If zero, DefaultMaxPeers is used.
+	MaxPeers int
+
+	// Trackers, if set, is used for tracker exchange with peers.
+	Trackers peer.TrackerExchange
+
+	// Picker chooses which pieces to download. If nil, NewRarestFirst's
+	// picker is used.
+	Picker PiecePicker
+
+	// Blocks are requested from each peer ahead of time, across pieces,
+	// so it never waits on us. QueueDepth is how many requests are kept
+	// outstanding with a peer at first; the number grows with the peer's
+	// throughput, up to MaxQueueDepth or the number the peer says it will
+	// queue, whichever is less. If zero, the defaults are used.
+	QueueDepth    int
+	MaxQueueDepth int
+
+	// RequestTimeout is how long a request may go unanswered before it's
+	// made of another peer. If zero, DefaultRequestTimeout is used.
+	RequestTimeout time.Duration
+
+	// LazyBitfield, if set, leaves a few of the pieces we have out of the
+	// bitfield we send each peer, and sends have messages for them
+	// afterwards instead, as some ISPs are said to throttle connections
+	// whose bitfields show a complete torrent.
+	LazyBitfield bool
+
+	tf      torrentfile.TorrentFile
+	id      peer.ID
+	storage io.WriterAt
+
+	mu         sync.Mutex
+	ctx        context.Context // Run's, or nil if not running
+	wg         sync.WaitGroup  // Peer goroutines
+	have       []bool
+	nHave      int
+	available  []int // How many connected peers have each piece
+	downloaded int64
+	duplicate  int64             // Bytes of blocks we already had
+	pieces     map[uint32]*piece // Pieces with some blocks requested
+	conns      map[string]*conn  // By address, including those connecting
+	candidates []peer.Peer       // Peers yet to be dialled
+	seen       map[string]bool   // Addresses connected or to be dialled
+	wake       chan struct{}     // Poked when there may be peers to dial
+	done       chan struct{}     // Closed once every piece is verified
+	err        error             // Set if writing to storage fails
+}
+
+// New returns a Swarm that downloads tf, identifying itself to peers as id,
+// and writing the torrent's contents to storage as they arrive.
+func New(tf torrentfile.TorrentFile, id peer.ID, storage io.WriterAt) *Swarm {
+	s := &Swarm{
+		tf:        tf,
+		id:        id,
+		storage:   storage,
+		have:      make([]bool, len(tf.Info.Pieces)),
+		available: make([]int, len(tf.Info.Pieces)),
+		pieces:    make(map[uint32]*piece),
+		conns:     make(map[string]*conn),
+		seen:      make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if len(s.have) == 0 {
+		close(s.done)
+	}
+	return s
+}
+
+// Downloaded returns the number of bytes in verified pieces.
+func (s *Swarm) Downloaded() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloaded
+}
+
+// Duplicate returns the number of bytes received in blocks we already had,
+// which is mostly the cost of endgame mode.
+func (s *Swarm) Duplicate() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duplicate
+}
+
+// Left returns the number of bytes still to download.
+func (s *Swarm) Left() int64 {
+	return s.tf.Info.TotalLength() - s.Downloaded()
+}
+
+// AddPeers adds peers to be connected to, learned from src. Peers that are
+// already connected or waiting to be dialled are ignored; those we've been
+// disconnected from are dialled again. If the torrent is private and src
+// isn't one it may use, they're all ignored.
+func (s *Swarm) AddPeers(src peer.Source, peers []peer.Peer) {
+	if !peer.SourceAllowed(s.tf, src) {
+		log.Printf("Ignoring %v peers from %v for private torrent", len(peers), src)
+		return
+	}
+	s.mu.Lock()
+	for _, p := range peers {
+		addr := p.Addr()
+		if !s.seen[addr] {
+			s.seen[addr] = true
+			s.candidates = append(s.candidates, p)
+		}
+	}
+	s.mu.Unlock()
+	s.poke()
+}
+
+// AddConn hands the Swarm a connection from a peer that connected to us.
+// It's closed if the Swarm isn't running or already has MaxPeers peers.
+func (s *Swarm) AddConn(nc net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := nc.RemoteAddr().String()
+	if s.ctx == nil || !peer.SourceAllowed(s.tf, peer.SourceIncoming) || len(s.conns) >= s.maxPeers() || s.conns[addr] != nil {
+		nc.Close()
+		return
+	}
+	c := s.newConn(addr)
+	s.wg.Add(1)
+	go func(ctx context.Context) {
+		defer s.wg.Done()
+		if err := c.p.Accept(ctx, nc, s.tf); err != nil {
+			log.Printf("Handshake with %v failed: %v", addr, err)
+			s.drop(c)
+			return
+		}
+		s.serve(ctx, c)
+	}(s.ctx)
+}
+
+func (s *Swarm) maxPeers() int {
+	if s.MaxPeers > 0 {
+		return s.MaxPeers
+	}
+	return DefaultMaxPeers
+}
+
+func (s *Swarm) requestTimeout() time.Duration {
+	if s.RequestTimeout > 0 {
+		return s.RequestTimeout
+	}
+	return DefaultRequestTimeout
+}
+
+func (s *Swarm) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run downloads the torrent, returning nil once every piece has been
+// verified and written, or an error if ctx is done first or writing to
+// storage fails. Either way, all connections are closed before it returns.
+func (s *Swarm) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	if s.ctx != nil {
+		s.mu.Unlock()
+		return errors.New("swarm is already running")
+	}
+	s.ctx = ctx
+	if s.Picker == nil {
+		s.Picker = NewRarestFirst()
+	}
+	s.mu.Unlock()
+
+	var err error
+loop:
+	for {
+		s.mu.Lock()
+		if s.err != nil {
+			err = s.err
+			s.mu.Unlock()
+			break loop
+		}
+		for len(s.candidates) > 0 && len(s.conns) < s.maxPeers() {
+			p := s.candidates[0]
+			s.candidates = s.candidates[1:]
+			s.dial(ctx, p)
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.done:
+			break loop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case <-s.wake:
+		}
+	}
+
+	s.mu.Lock()
+	s.ctx = nil
+	s.mu.Unlock()
+	cancel()
+	s.wg.Wait()
+	return err
+}
+
+// dial connects to p in a new goroutine. Called with mu held.
+func (s *Swarm) dial(ctx context.Context, p peer.Peer) {
+	addr := p.Addr()
+	if s.conns[addr] != nil {
+		return
+	}
+	c := s.newConn(addr)
+	c.p.IPAddress = p.IPAddress
+	c.p.Port = p.Port
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := c.p.Connect(ctx, s.tf); err != nil {
+			log.Printf("Connecting to %v failed: %v", addr, err)
+			s.drop(c)
+			return
+		}
+		s.serve(ctx, c)
+	}()
+}
+
+// newConn registers a connection to the peer at addr. Called with mu held.
+func (s *Swarm) newConn(addr string) *conn {
+	c := &conn{
+		addr:   addr,
+		p:      &peer.Peer{LocalID: s.id, Trackers: s.Trackers},
+		has:    peer.NewBitfield(len(s.have)),
+		choked: true,
+		kick:   make(chan struct{}, 1),
+	}
+	s.conns[addr] = c
+	return c
+}
+
+// drop forgets c, handing back any piece it was downloading. The peer may be
+// added again, as trackers will keep telling us about it.
+func (s *Swarm) drop(c *conn) {
+	s.mu.Lock()
+	delete(s.seen, c.addr)
+	s.release(c)
+	for i := range s.have {
+		if c.has.Has(i) {
+			s.available[i]--
+		}
+	}
+	delete(s.conns, c.addr)
+	s.mu.Unlock()
+	s.poke()
+}
+
+// verify checks a completed piece, downloaded from c, against its hash and
+// writes it to storage, then tells all our peers we have it.
+func (s *Swarm) verify(c *conn, pc *piece) error {
+	sum := sha1.Sum(pc.buf)
+	if string(sum[:]) != string(s.tf.Info.Pieces[pc.index]) {
+		s.mu.Lock()
+		delete(s.pieces, pc.index)
+		s.mu.Unlock()
+		return fmt.Errorf("piece %v failed its hash check", pc.index)
+	}
+	off := int64(pc.index) * int64(s.tf.Info.PieceLength)
+	_, err := s.storage.WriteAt(pc.buf, off)
+
+	s.mu.Lock()
+	delete(s.pieces, pc.index)
+	if err != nil {
+		// Not the peer's fault, but there's no point carrying on
+		err = fmt.Errorf("writing piece %v: %w", pc.index, err)
+		if s.err == nil {
+			s.err = err
+			s.poke()
+		}
+		s.mu.Unlock()
+		return err
+	}
+	s.have[pc.index] = true
+	s.nHave++
+	s.downloaded += int64(len(pc.buf))
+	log.Printf("Completed piece %v from %v, %v/%v", pc.index, c.addr, s.nHave, len(s.have))
+	if s.nHave == len(s.have) {
+		close(s.done)
+	}
+	var ready []*peer.Peer
+	for _, other := range s.conns {
+		if other.ready {
+			ready = append(ready, other.p)
+		}
+	}
+	s.mu.Unlock()
+
+	// Outside the lock, as a peer that isn't reading could block us
+	for _, p := range ready {
+		p.Have(pc.index)
+	}
+	return nil
+}
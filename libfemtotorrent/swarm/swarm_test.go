@@ -0,0 +1,570 @@
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// testTorrent returns a torrent of random data, with a short last piece.
+func testTorrent(pieceLength, length int) (torrentfile.TorrentFile, []byte) {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(1)).Read(data)
+	tf := torrentfile.TorrentFile{InfoHash: sha1.Sum([]byte("test"))}
+	tf.Info.Length = int64(length)
+	tf.Info.PieceLength = pieceLength
+	for i := 0; i < length; i += pieceLength {
+		end := i + pieceLength
+		if end > length {
+			end = length
+		}
+		sum := sha1.Sum(data[i:end])
+		tf.Info.Pieces = append(tf.Info.Pieces, sum[:])
+	}
+	return tf, data
+}
+
+// memStorage is an in-memory io.WriterAt.
+type memStorage struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (m *memStorage) WriteAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copy(m.buf[off:], b), nil
+}
+
+// seeder is a fake peer that has the whole torrent and serves any request.
+type seeder struct {
+	tf   torrentfile.TorrentFile
+	data []byte
+
+	// If nonzero, each connection is dropped after sending this many
+	// blocks.
+	dropAfter int
+
+	// If nonzero, requests are ignored after this many blocks are sent.
+	stallAfter int
+
+	// How long to take over each block, so requests pile up
+	delay time.Duration
+
+	// If nonzero, sent in an extension handshake.
+	reqq int
+
+	mu         sync.Mutex
+	requests   int
+	pending    int // Requested but not yet sent
+	maxPending int
+	cancels    int
+}
+
+// start listens for connections to s, returning the peer to connect to.
+func (s *seeder) start(t *testing.T) peer.Peer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c, false)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return peer.Peer{IPAddress: addr.IP, Port: uint16(addr.Port)}
+}
+
+// serve serves a connection; initiator says whether the seeder opened it, and
+// so sends its handshake first.
+func (s *seeder) serve(c net.Conn, initiator bool) {
+	defer c.Close()
+	hs := append([]byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00"), s.tf.InfoHash[:]...)
+	hs = append(hs, "-XX0001-seederseeder"...)
+	if s.reqq > 0 {
+		hs[20+5] |= 0x10
+	}
+	var reply []byte
+	if initiator {
+		if _, err := c.Write(hs); err != nil {
+			return
+		}
+	} else {
+		reply = hs
+	}
+	if _, err := io.ReadFull(c, make([]byte, 68)); err != nil {
+		return
+	}
+	if s.reqq > 0 {
+		ext := []byte(fmt.Sprintf("\x00d1:mde4:reqqi%vee", s.reqq))
+		reply = append(reply, writeMessage(20, ext)...)
+	}
+	bitfield := make([]byte, (len(s.tf.Info.Pieces)+7)/8)
+	for i := range s.tf.Info.Pieces {
+		bitfield[i/8] |= 0x80 >> (i % 8)
+	}
+	reply = append(reply, writeMessage(peer.MsgBitfield, bitfield)...)
+	reply = append(reply, writeMessage(peer.MsgUnchoke, nil)...)
+	if _, err := c.Write(reply); err != nil {
+		return
+	}
+
+	// Requests are read on another goroutine, so they can queue up
+	requests := make(chan []byte, 1000)
+	go func() {
+		defer close(requests)
+		for {
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(c, header); err != nil {
+				return
+			}
+			payload := make([]byte, binary.BigEndian.Uint32(header)-1)
+			if _, err := io.ReadFull(c, payload); err != nil {
+				return
+			}
+			if header[4] == peer.MsgCancel {
+				s.mu.Lock()
+				s.cancels++
+				s.mu.Unlock()
+			}
+			if header[4] != peer.MsgRequest {
+				continue
+			}
+			s.mu.Lock()
+			s.requests++
+			s.pending++
+			if s.pending > s.maxPending {
+				s.maxPending = s.pending
+			}
+			s.mu.Unlock()
+			requests <- payload
+		}
+	}()
+
+	sent := 0
+	for payload := range requests {
+		if s.dropAfter > 0 && sent == s.dropAfter {
+			return
+		}
+		if s.stallAfter > 0 && sent >= s.stallAfter {
+			continue
+		}
+		time.Sleep(s.delay)
+		index := binary.BigEndian.Uint32(payload)
+		begin := binary.BigEndian.Uint32(payload[4:])
+		length := binary.BigEndian.Uint32(payload[8:])
+		off := int(index)*s.tf.Info.PieceLength + int(begin)
+		block := append(payload[:8:8], s.data[off:off+int(length)]...)
+		s.mu.Lock()
+		s.pending--
+		s.mu.Unlock()
+		if _, err := c.Write(writeMessage(peer.MsgPiece, block)); err != nil {
+			return
+		}
+		sent++
+	}
+}
+
+func writeMessage(msgType uint8, payload []byte) []byte {
+	msg := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(msg, uint32(1+len(payload)))
+	msg[4] = msgType
+	return append(msg, payload...)
+}
+
+func TestSwarm(t *testing.T) {
+	tf, data := testTorrent(2*peer.BlockSize, 9*peer.BlockSize+1000)
+	flaky := &seeder{tf: tf, data: data, dropAfter: 1}
+	good := &seeder{tf: tf, data: data}
+	storage := &memStorage{buf: make([]byte, len(data))}
+	s := New(tf, peer.ID{'-', 'F', 'T'}, storage)
+	s.AddPeers(peer.SourceTracker, []peer.Peer{flaky.start(t), good.start(t)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.buf, data) {
+		t.Error("downloaded data doesn't match")
+	}
+	if s.Downloaded() != int64(len(data)) || s.Left() != 0 {
+		t.Errorf("Downloaded() == %v and Left() == %v after downloading %v bytes", s.Downloaded(), s.Left(), len(data))
+	}
+	good.mu.Lock()
+	defer good.mu.Unlock()
+	if good.requests == 0 {
+		t.Error("no blocks requested from the reliable seeder")
+	}
+}
+
+// incoming waits for s to start running, then returns both ends of a
+// connection, the local one to hand to s as if a peer connected to us.
+func incoming(t *testing.T, s *Swarm) (local, remote net.Conn) {
+	t.Helper()
+	for {
+		s.mu.Lock()
+		running := s.ctx != nil
+		s.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+	local, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local, remote
+}
+
+func TestSwarmIncoming(t *testing.T) {
+	tf, data := testTorrent(peer.BlockSize, 3*peer.BlockSize)
+	storage := &memStorage{buf: make([]byte, len(data))}
+	s := New(tf, peer.ID{'-', 'F', 'T'}, storage)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+
+	local, remote := incoming(t, s)
+	seed := &seeder{tf: tf, data: data}
+	go seed.serve(remote, true)
+	s.AddConn(local)
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.buf, data) {
+		t.Error("downloaded data doesn't match")
+	}
+}
+
+func TestSwarmRedial(t *testing.T) {
+	// A peer that keeps disconnecting is dialled again each time the
+	// tracker mentions it
+	tf, data := testTorrent(peer.BlockSize, 4*peer.BlockSize)
+	flaky := &seeder{tf: tf, data: data, dropAfter: 1}
+	p := flaky.start(t)
+	storage := &memStorage{buf: make([]byte, len(data))}
+	s := New(tf, peer.ID{'-', 'F', 'T'}, storage)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(storage.buf, data) {
+				t.Error("downloaded data doesn't match")
+			}
+			return
+		case <-ticker.C:
+			s.AddPeers(peer.SourceTracker, []peer.Peer{p})
+		}
+	}
+}
+
+func TestSwarmPrivate(t *testing.T) {
+	tf, _ := testTorrent(peer.BlockSize, peer.BlockSize)
+	tf.Info.Private = true
+	s := New(tf, peer.ID{'-', 'F', 'T'}, &memStorage{buf: make([]byte, peer.BlockSize)})
+	p := peer.Peer{IPAddress: net.IP{10, 0, 0, 1}, Port: 6881}
+	s.AddPeers(peer.SourcePEX, []peer.Peer{p})
+	if len(s.candidates) != 0 {
+		t.Errorf("private torrent accepted a peer from PEX")
+	}
+	s.AddPeers(peer.SourceTracker, []peer.Peer{p})
+	if len(s.candidates) != 1 {
+		t.Errorf("private torrent refused a peer from its tracker")
+	}
+}
+
+func TestSwarmCancel(t *testing.T) {
+	tf, _ := testTorrent(peer.BlockSize, peer.BlockSize)
+	s := New(tf, peer.ID{'-', 'F', 'T'}, &memStorage{buf: make([]byte, peer.BlockSize)})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Run() == %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSwarmPipelining(t *testing.T) {
+	cases := []struct {
+		reqq int
+		want int
+	}{
+		{0, DefaultQueueDepth},
+		{2, 2},
+	}
+	for _, c := range cases {
+		// Pieces of two blocks, so a full queue spans several pieces
+		tf, data := testTorrent(2*peer.BlockSize, 12*peer.BlockSize)
+		slow := &seeder{tf: tf, data: data, delay: 10 * time.Millisecond, reqq: c.reqq}
+		s := New(tf, peer.ID{'-', 'F', 'T'}, &memStorage{buf: make([]byte, len(data))})
+		s.AddPeers(peer.SourceTracker, []peer.Peer{slow.start(t)})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.Run(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slow.mu.Lock()
+		if slow.maxPending != c.want {
+			t.Errorf("with reqq %v, %v requests were outstanding at once, want %v", c.reqq, slow.maxPending, c.want)
+		}
+		slow.mu.Unlock()
+	}
+}
+
+func TestSwarmStalledRequests(t *testing.T) {
+	tf, data := testTorrent(2*peer.BlockSize, 8*peer.BlockSize)
+	stalled := &seeder{tf: tf, data: data, stallAfter: 1}
+	storage := &memStorage{buf: make([]byte, len(data))}
+	s := New(tf, peer.ID{'-', 'F', 'T'}, storage)
+	s.RequestTimeout = 100 * time.Millisecond
+	s.AddPeers(peer.SourceTracker, []peer.Peer{stalled.start(t)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+
+	// Only once the stalled peer's requests time out is there anything for
+	// a second peer to do
+	time.Sleep(50 * time.Millisecond)
+	good := &seeder{tf: tf, data: data}
+	s.AddPeers(peer.SourceTracker, []peer.Peer{good.start(t)})
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.buf, data) {
+		t.Error("downloaded data doesn't match")
+	}
+}
+
+func TestSwarmEndgame(t *testing.T) {
+	tf, data := testTorrent(peer.BlockSize, 4*peer.BlockSize)
+	slow := &seeder{tf: tf, data: data, delay: time.Minute}
+	storage := &memStorage{buf: make([]byte, len(data))}
+	s := New(tf, peer.ID{'-', 'F', 'T'}, storage)
+	s.AddPeers(peer.SourceTracker, []peer.Peer{slow.start(t)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+
+	// Once every block is requested from the slow peer, there's nothing
+	// left for a second peer but to ask for the same blocks
+	for {
+		slow.mu.Lock()
+		requests := slow.requests
+		slow.mu.Unlock()
+		if requests == len(tf.Info.Pieces) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fast := &seeder{tf: tf, data: data}
+	s.AddPeers(peer.SourceTracker, []peer.Peer{fast.start(t)})
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storage.buf, data) {
+		t.Error("downloaded data doesn't match")
+	}
+	// Cancels are sent just before the connection closes, so may not
+	// all have been read yet
+	time.Sleep(10 * time.Millisecond)
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	if slow.cancels == 0 {
+		t.Error("no requests to the slow peer were cancelled")
+	}
+}
+
+func TestEndgameBlock(t *testing.T) {
+	tf, data := testTorrent(peer.BlockSize, 3*peer.BlockSize)
+	s := New(tf, peer.ID{'-', 'F', 'T'}, &memStorage{buf: make([]byte, len(data))})
+	a, b := s.newConn("a"), s.newConn("b")
+	for i := range tf.Info.Pieces {
+		s.setHas(a, i, true)
+		s.setHas(b, i, true)
+	}
+	s.have[0] = true
+	s.nHave = 1
+	s.pieces[1] = newPiece(1, peer.BlockSize)
+	s.pieces[1].blocks[0] = block{state: blockRequested, from: []*conn{a}}
+	if pc, _ := s.endgameBlock(b); pc != nil {
+		t.Errorf("endgameBlock chose piece %v while piece 2 wasn't started", pc.index)
+	}
+
+	s.pieces[2] = newPiece(2, peer.BlockSize)
+	s.pieces[2].blocks[0] = block{state: blockRequested, from: []*conn{a, b}}
+	if pc, _ := s.endgameBlock(b); pc == nil || pc.index != 1 {
+		t.Errorf("endgameBlock chose %v, want piece 1", pc)
+	}
+	if pc, _ := s.endgameBlock(a); pc != nil {
+		t.Errorf("endgameBlock chose piece %v, already requested from the same peer", pc.index)
+	}
+
+	// Blocks of pieces we've verified are counted as duplicates
+	payload := make([]byte, 8+peer.BlockSize)
+	if err := s.receive(b, peer.Message{Type: peer.MsgPiece, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Duplicate() != peer.BlockSize {
+		t.Errorf("Duplicate() == %v, want %v", s.Duplicate(), peer.BlockSize)
+	}
+}
+
+func TestSwarmBitfield(t *testing.T) {
+	// msgExtended is the type of extension protocol messages
+	const msgExtended = 20
+	cases := []struct{ lazy, extended bool }{{false, false}, {true, false}, {false, true}, {true, true}}
+	for _, c := range cases {
+		lazy := c.lazy
+		tf, data := testTorrent(peer.BlockSize, 20*peer.BlockSize)
+		s := New(tf, peer.ID{'-', 'F', 'T'}, &memStorage{buf: make([]byte, len(data))})
+		s.LazyBitfield = lazy
+		want := peer.NewBitfield(len(tf.Info.Pieces))
+		for i := 0; i < 10; i++ {
+			s.have[i] = true
+			s.nHave++
+			want.Set(i)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		errc := make(chan error, 1)
+		go func() { errc <- s.Run(ctx) }()
+		local, remote := incoming(t, s)
+		s.AddConn(local)
+
+		hs := append([]byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00"), tf.InfoHash[:]...)
+		hs = append(hs, "-XX0001-leecherleech"...)
+		if c.extended {
+			hs[20+5] |= 0x10
+		}
+		if _, err := remote.Write(hs); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(remote, make([]byte, 68)); err != nil {
+			t.Fatal(err)
+		}
+		got := peer.NewBitfield(len(tf.Info.Pieces))
+		var types []uint8
+		extended := false
+		for got.Count() < want.Count() || c.extended && !extended {
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(remote, header); err != nil {
+				t.Fatal(err)
+			}
+			payload := make([]byte, binary.BigEndian.Uint32(header)-1)
+			if _, err := io.ReadFull(remote, payload); err != nil {
+				t.Fatal(err)
+			}
+			msg := peer.Message{Type: header[4], Payload: payload}
+			types = append(types, msg.Type)
+			switch msg.Type {
+			case peer.MsgBitfield:
+				b, err := msg.Bitfield(len(tf.Info.Pieces))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range tf.Info.Pieces {
+					if b.Has(i) {
+						got.Set(i)
+					}
+				}
+			case peer.MsgHave:
+				i, err := msg.Have()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got.Set(int(i))
+			case msgExtended:
+				extended = true
+			}
+		}
+		cancel()
+		<-errc
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("with lazy %v, peer was told we have %x, want %x", lazy, []byte(got), []byte(want))
+		}
+		if types[0] != peer.MsgBitfield {
+			t.Errorf("with lazy %v, first message was type %v, want a bitfield", lazy, types[0])
+		}
+		// The extension handshake comes straight after the bitfield
+		if c.extended && (len(types) < 2 || types[1] != msgExtended) {
+			t.Errorf("with lazy %v, messages sent were of types %v, want the extension handshake second", lazy, types)
+		}
+		haves := 0
+		for _, typ := range types {
+			if typ == peer.MsgHave {
+				haves++
+			}
+		}
+		if !lazy && haves != 0 || lazy && haves != lazyHaves {
+			t.Errorf("with lazy %v, %v have messages were sent", lazy, haves)
+		}
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	s := &Swarm{QueueDepth: 4, MaxQueueDepth: 100}
+	cases := []struct {
+		rate    float64
+		snubbed bool
+		want    int
+	}{
+		{0, false, 4},
+		{peer.BlockSize, false, 4},
+		{10 * peer.BlockSize, false, 30},
+		{1000 * peer.BlockSize, false, 100},
+		{1000 * peer.BlockSize, true, 1},
+	}
+	for _, c := range cases {
+		got := s.queueDepth(&conn{p: &peer.Peer{}, rate: c.rate, snubbed: c.snubbed})
+		if got != c.want {
+			t.Errorf("queueDepth at %v bytes/s, snubbed %v == %v, want %v", c.rate, c.snubbed, got, c.want)
+		}
+	}
+}
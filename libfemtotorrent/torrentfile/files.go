@@ -0,0 +1,129 @@
+package torrentfile
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Names that Windows reserves for devices, with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkPathComponent returns an error if name isn't safe to use as a single
+// component of a path on disk. The torrent is untrusted input, so anything
+// that could escape the download directory (.., absolute paths, separators)
+// or that some platform would treat specially is rejected.
+func checkPathComponent(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("path component %q not allowed", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("path component %q contains a separator or NUL", name)
+	case len(name) >= 2 && name[1] == ':':
+		return fmt.Errorf("path component %q looks like a drive letter", name)
+	}
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return fmt.Errorf("path component %q is a reserved name", name)
+	}
+	return nil
+}
+
+func filesFromRaw(raw []rawFile) ([]File, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("files property is empty")
+	}
+	files := make([]File, len(raw))
+	var total int64
+	for i, rf := range raw {
+		if rf.Length == nil {
+			return nil, fmt.Errorf("length property not found in file %v", i)
+		}
+		if *rf.Length < 0 || *rf.Length > math.MaxInt64-total {
+			return nil, fmt.Errorf("invalid length %v for file %v", *rf.Length, i)
+		}
+		total += *rf.Length
+		if len(rf.Path) == 0 {
+			return nil, fmt.Errorf("path property not found in file %v", i)
+		}
+		path := make([]string, len(rf.Path))
+		for j, component := range rf.Path {
+			path[j] = string(component)
+			if err := checkPathComponent(path[j]); err != nil {
+				return nil, fmt.Errorf("invalid path for file %v: %w", i, err)
+			}
+		}
+		files[i] = File{Path: path, Length: *rf.Length, MD5Sum: rf.MD5Sum}
+	}
+	return files, nil
+}
+
+// TotalLength returns the combined length of all the files in the torrent.
+func (info TorrentFileInfo) TotalLength() int64 {
+	if info.Files == nil {
+		return info.Length
+	}
+	var total int64
+	for _, f := range info.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// PieceSize returns the length of piece index, which is PieceLength for all
+// but the last piece.
+func (info TorrentFileInfo) PieceSize(index int) int64 {
+	pieceLength := int64(info.PieceLength)
+	start := int64(index) * pieceLength
+	if remaining := info.TotalLength() - start; remaining < pieceLength {
+		return remaining
+	}
+	return pieceLength
+}
+
+// FileRange is a run of bytes within a single file.
+type FileRange struct {
+	File   int   // Index into Files, or 0 for a single file torrent
+	Offset int64 // From the start of the file
+	Length int64
+}
+
+// PieceFiles returns the ranges of the files covered by piece index, in the
+// order they appear in the piece. Empty files cover no bytes, so never appear.
+func (info TorrentFileInfo) PieceFiles(index int) ([]FileRange, error) {
+	if index < 0 || index >= len(info.Pieces) {
+		return nil, fmt.Errorf("piece index %v out of range [0, %v)", index, len(info.Pieces))
+	}
+	start := int64(index) * int64(info.PieceLength)
+	length := info.PieceSize(index)
+
+	if info.Files == nil {
+		return []FileRange{{File: 0, Offset: start, Length: length}}, nil
+	}
+
+	var ranges []FileRange
+	var fileStart int64
+	for i, f := range info.Files {
+		fileEnd := fileStart + f.Length
+		if fileEnd > start && length > 0 {
+			n := fileEnd - start
+			if n > length {
+				n = length
+			}
+			ranges = append(ranges, FileRange{File: i, Offset: start - fileStart, Length: n})
+			start += n
+			length -= n
+		}
+		fileStart = fileEnd
+	}
+	return ranges, nil
+}
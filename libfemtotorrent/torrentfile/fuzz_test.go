@@ -0,0 +1,49 @@
+package torrentfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// FuzzDecodeTorrentFile checks that no input makes DecodeTorrentFile panic,
+// and that ReadTorrentFile agrees with it.
+func FuzzDecodeTorrentFile(f *testing.F) {
+	seeds, err := filepath.Glob("../testdata/*.torrent")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, pattern := range []string{"../testdata/noncanonical/*", "../testdata/hostile/*"} {
+		more, err := filepath.Glob(pattern)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, more...)
+	}
+	for _, path := range seeds {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tf, err := DecodeTorrentFile(data)
+		if err != nil {
+			return
+		}
+		if tf.Info.PieceLength <= 0 || tf.Info.Length < 0 {
+			t.Fatalf("DecodeTorrentFile(%q) accepted piece length %v and length %v", data, tf.Info.PieceLength, tf.Info.Length)
+		}
+		streamed, err := ReadTorrentFile(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ReadTorrentFile(%q) returned error %v, but DecodeTorrentFile didn't", data, err)
+		}
+		if !reflect.DeepEqual(tf, streamed) {
+			t.Fatalf("ReadTorrentFile(%q) == %+v, DecodeTorrentFile returned %+v", data, streamed, tf)
+		}
+	})
+}
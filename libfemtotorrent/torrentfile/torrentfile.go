@@ -3,6 +3,7 @@ package torrentfile
 import (
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
@@ -10,6 +11,7 @@ import (
 
 type TorrentFile struct {
 	Announce     string
+	AnnounceList [][]string // Tiers of tracker URLs, from BEP 12; may be nil
 	Comment      string
 	CreationDate time.Time
 	HTTPSeeds    []string
@@ -18,83 +20,174 @@ type TorrentFile struct {
 }
 
 type TorrentFileInfo struct {
-	Length      int    // Either this or Files is present
+	Length      int64  // Either this or Files is present
 	Files       []File // Either this or Length is present
 	Name        string
 	Pieces      [][]byte
 	PieceLength int
+
+	// Private torrents (BEP 27) may only get peers from their own trackers:
+	// not from DHT, peer exchange or local peer discovery.
+	Private bool
 }
 
 type File struct {
-	Path   string
-	Length int
+	Path   []string // Path components, relative to the directory named by Info.Name
+	Length int64
+	MD5Sum string // Optional, and hex encoded if present
+}
+
+// Tiers returns the torrent's trackers, grouped into tiers as described by
+// BEP 12. If the torrent has an announce-list, Announce is ignored, as the
+// spec requires; otherwise there is a single tier holding just Announce.
+func (tf TorrentFile) Tiers() [][]string {
+	if tf.AnnounceList != nil {
+		return tf.AnnounceList
+	}
+	return [][]string{{tf.Announce}}
+}
+
+// rawTorrentFile mirrors the bencoded layout of a .torrent file.
+type rawTorrentFile struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	Comment      string     `bencode:"comment"`
+	CreationDate int64      `bencode:"creation date"`
+	HTTPSeeds    []string   `bencode:"httpseeds"`
+
+	// The info dictionary is kept exactly as it appears in the file, as it's
+	// hashed to identify the torrent.
+	Info bencoding.RawMessage `bencode:"info"`
 }
 
+type rawInfo struct {
+	Files       []rawFile `bencode:"files"`
+	Length      *int64    `bencode:"length"`
+	Name        []byte    `bencode:"name"`
+	PieceLength int       `bencode:"piece length"`
+	Pieces      []byte    `bencode:"pieces"`
+	Private     int       `bencode:"private"`
+}
+
+type rawFile struct {
+	Length *int64   `bencode:"length"`
+	MD5Sum string   `bencode:"md5sum"`
+	Path   [][]byte `bencode:"path"`
+}
+
+// DecodeTorrentFile decodes a .torrent file. To save copying the (often
+// large) piece hashes, the returned TorrentFile shares memory with data.
 func DecodeTorrentFile(data []byte) (tf TorrentFile, err error) {
-	raw, err := bencoding.Decode(data)
+	var raw rawTorrentFile
+	err = bencoding.Unmarshal(data, &raw)
 	if err != nil {
 		return
 	}
-	rawDict, ok := raw.(map[string]interface{})
-	if !ok {
-		return tf, fmt.Errorf("Torrent (type %T) could not be decoded as map[string]interface{}", raw)
+	return fromRaw(raw)
+}
+
+// ReadTorrentFile is like DecodeTorrentFile, but reads the torrent from r.
+func ReadTorrentFile(r io.Reader) (tf TorrentFile, err error) {
+	var raw rawTorrentFile
+	err = bencoding.NewDecoder(r).Decode(&raw)
+	if err != nil {
+		return
+	}
+	return fromRaw(raw)
+}
+
+func fromRaw(raw rawTorrentFile) (tf TorrentFile, err error) {
+	tf.Announce = raw.Announce
+	for _, tier := range raw.AnnounceList {
+		var urls []string
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			tf.AnnounceList = append(tf.AnnounceList, urls)
+		}
 	}
-	announce, ok := rawDict["announce"].([]byte)
-	if !ok {
-		return tf, fmt.Errorf("announce property not found in rawDict")
+	if tf.Announce == "" && tf.AnnounceList == nil {
+		return tf, fmt.Errorf("announce property not found in torrent")
 	}
-	tf.Announce = string(announce)
 
 	// Not mandated by the spec
-	if comment, ok := rawDict["comment"].([]byte); ok {
-		tf.Comment = string(comment)
-	}
-
-	info, ok := rawDict["info"].(map[string]interface{})
-	if !ok {
-		return tf, fmt.Errorf("info property not found in rawDict")
-	}
-
-	// TODO: this isn't entirely right. From the spec:
-	//
-	// The 20 byte sha1 hash of the bencoded form of the info value
-	// from the metainfo file. This value will almost certainly have to be
-	// escaped. Note that this is a substring of the metainfo file. The
-	// info-hash must be the hash of the encoded form as found in the .torrent
-	// file, which is identical to bdecoding the metainfo file, extracting the
-	// info dictionary and encoding it if and only if the bdecoder fully
-	// validated the input (e.g. key ordering, absence of leading zeros).
-	// Conversely that means clients must either reject invalid metainfo files
-	// or extract the substring directly. They must not perform a decode-encode
-	// roundtrip on invalid data.
-	infoBytes, err := bencoding.Encode(info)
+	tf.Comment = raw.Comment
+	if raw.CreationDate != 0 {
+		tf.CreationDate = time.Unix(raw.CreationDate, 0)
+	}
+	tf.HTTPSeeds = raw.HTTPSeeds
+
+	if raw.Info == nil {
+		return tf, fmt.Errorf("info property not found in torrent")
+	}
+
+	// From the spec: the info-hash must be the hash of the encoded form as
+	// found in the .torrent file, which is identical to bdecoding the metainfo
+	// file, extracting the info dictionary and encoding it if and only if the
+	// bdecoder fully validated the input (e.g. key ordering, absence of leading
+	// zeros). Conversely that means clients must either reject invalid
+	// metainfo files or extract the substring directly. We do the latter.
+	tf.InfoHash = sha1.Sum(raw.Info)
+
+	var info rawInfo
+	err = bencoding.Unmarshal(raw.Info, &info)
 	if err != nil {
 		return
 	}
-	tf.InfoHash = sha1.Sum(infoBytes)
 
-	name, ok := info["name"].([]byte)
-	if !ok {
+	if info.Name == nil {
 		return tf, fmt.Errorf("name property not found in info")
 	}
-	tf.Info.Name = string(name)
+	tf.Info.Name = string(info.Name)
+	if err = checkPathComponent(tf.Info.Name); err != nil {
+		return tf, fmt.Errorf("invalid name: %w", err)
+	}
 
-	pieceLength, ok := info["piece length"].(int)
-	if !ok {
+	if info.PieceLength == 0 {
 		return tf, fmt.Errorf("piece length property not found in info")
+	} else if info.PieceLength < 0 {
+		return tf, fmt.Errorf("invalid piece length %v", info.PieceLength)
 	}
-	tf.Info.PieceLength = pieceLength
+	tf.Info.PieceLength = info.PieceLength
+	tf.Info.Private = info.Private == 1
 
-	if tf.Info.Length, ok = info["length"].(int); !ok {
+	switch {
+	case info.Length != nil && info.Files != nil:
+		return tf, fmt.Errorf("info has both length and files properties")
+	case info.Length != nil:
+		if *info.Length < 0 {
+			return tf, fmt.Errorf("invalid length %v", *info.Length)
+		}
+		tf.Info.Length = *info.Length
+	case info.Files != nil:
+		tf.Info.Files, err = filesFromRaw(info.Files)
+		if err != nil {
+			return
+		}
+	default:
 		return tf, fmt.Errorf("length property not found in info")
 	}
 
-	rawPieces, ok := info["pieces"].([]byte)
-	if !ok {
+	if info.Pieces == nil {
 		return tf, fmt.Errorf("pieces property not found in info")
 	}
-	for i := 0; i < len(rawPieces); i += 20 {
-		tf.Info.Pieces = append(tf.Info.Pieces, rawPieces[i:i+20])
+	if len(info.Pieces)%20 != 0 {
+		return tf, fmt.Errorf("pieces length %v is not a multiple of 20", len(info.Pieces))
+	}
+	for i := 0; i < len(info.Pieces); i += 20 {
+		tf.Info.Pieces = append(tf.Info.Pieces, info.Pieces[i:i+20])
+	}
+	pieceLength := int64(tf.Info.PieceLength)
+	totalLength := tf.Info.TotalLength()
+	want := totalLength / pieceLength
+	if totalLength%pieceLength != 0 {
+		want++
+	}
+	if int64(len(tf.Info.Pieces)) != want {
+		return tf, fmt.Errorf("expected %v pieces for length %v, got %v", want, totalLength, len(tf.Info.Pieces))
 	}
 
 	return
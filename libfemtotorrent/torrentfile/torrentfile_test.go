@@ -0,0 +1,192 @@
+package torrentfile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInfoHash(t *testing.T) {
+	cases := []struct {
+		file string
+		want string
+	}{
+		{"../testdata/debian-11.2.0-amd64-netinst.iso.torrent", "28c55196f57753c40aceb6fb58617e6995a7eddb"},
+
+		// These aren't canonically encoded, so re-encoding the info dict would
+		// give a different hash.
+		{"../testdata/noncanonical/leading-zeros.torrent", "56bac7edf3fb6e0b26c0c2e52545db6fd64e1131"},
+		{"../testdata/noncanonical/unsorted-keys.torrent", "3fa609a1e8b35cd6201e3d0cd13cd879815cff46"},
+		{"../testdata/noncanonical/negative-zero.torrent", "bce30d543b59a48111da9f165e01b8380d54f493"},
+		{"../testdata/noncanonical/string-length-leading-zero.torrent", "4ce9f15b0bc536496da31f8559d0e6134facedcd"},
+	}
+	for _, c := range cases {
+		f, err := os.Open(c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tf, err := ReadTorrentFile(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("ReadTorrentFile(%v) returned error %v", c.file, err)
+			continue
+		}
+		if got := hex.EncodeToString(tf.InfoHash[:]); got != c.want {
+			t.Errorf("ReadTorrentFile(%v).InfoHash == %v, want %v", c.file, got, c.want)
+		}
+	}
+}
+
+func TestDecodeTorrentFile(t *testing.T) {
+	b, err := ioutil.ReadFile("../testdata/debian-11.2.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := DecodeTorrentFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Announce != "http://bttracker.debian.org:6969/announce" {
+		t.Errorf("Announce == %v", tf.Announce)
+	}
+	if tf.Info.Name != "debian-11.2.0-amd64-netinst.iso" {
+		t.Errorf("Info.Name == %v", tf.Info.Name)
+	}
+	if tf.Info.Length != 396361728 || tf.Info.PieceLength != 262144 || len(tf.Info.Pieces) != 1512 {
+		t.Errorf("Info == {Length: %v, PieceLength: %v, %v pieces}", tf.Info.Length, tf.Info.PieceLength, len(tf.Info.Pieces))
+	}
+	if tf.CreationDate.Unix() != 1639833767 {
+		t.Errorf("CreationDate == %v", tf.CreationDate)
+	}
+}
+
+func TestDecodeMultiFile(t *testing.T) {
+	b, err := ioutil.ReadFile("../testdata/multifile.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := DecodeTorrentFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []File{
+		{Path: []string{"README"}, Length: 10, MD5Sum: "d41d8cd98f00b204e9800998ecf8427e"},
+		{Path: []string{"src", "empty"}, Length: 0},
+		{Path: []string{"src", "main.go"}, Length: 40000},
+		{Path: []string{"data", "blob.bin"}, Length: 30000},
+	}
+	if !reflect.DeepEqual(tf.Info.Files, want) {
+		t.Errorf("Info.Files == %+v, want %+v", tf.Info.Files, want)
+	}
+	if got := tf.Info.TotalLength(); got != 70010 {
+		t.Errorf("Info.TotalLength() == %v, want 70010", got)
+	}
+}
+
+func TestPieceFiles(t *testing.T) {
+	b, err := ioutil.ReadFile("../testdata/multifile.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := DecodeTorrentFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		index int
+		want  []FileRange
+	}{
+		{0, []FileRange{{File: 0, Offset: 0, Length: 10}, {File: 2, Offset: 0, Length: 16374}}},
+		{1, []FileRange{{File: 2, Offset: 16374, Length: 16384}}},
+		{2, []FileRange{{File: 2, Offset: 32758, Length: 7242}, {File: 3, Offset: 0, Length: 9142}}},
+		{4, []FileRange{{File: 3, Offset: 25526, Length: 4474}}},
+	}
+	for _, c := range cases {
+		got, err := tf.Info.PieceFiles(c.index)
+		if err != nil {
+			t.Errorf("PieceFiles(%v) returned error %v", c.index, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("PieceFiles(%v) == %+v, want %+v", c.index, got, c.want)
+		}
+	}
+	if _, err := tf.Info.PieceFiles(5); err == nil {
+		t.Errorf("PieceFiles(5) returned no error")
+	}
+}
+
+func TestUnsafePaths(t *testing.T) {
+	cases := [][]string{
+		{".."},
+		{"a", "..", "b"},
+		{"/etc", "passwd"},
+		{"a/b"},
+		{`..\evil`},
+		{"C:"},
+		{""},
+		{"con.txt"},
+		{"LPT1"},
+	}
+	for _, c := range cases {
+		var path bytes.Buffer
+		for _, component := range c {
+			fmt.Fprintf(&path, "%d:%s", len(component), component)
+		}
+		info := fmt.Sprintf("d5:filesld6:lengthi1e4:pathl%seee4:name1:x12:piece lengthi1e6:pieces20:%se", path.String(), strings.Repeat("x", 20))
+		data := fmt.Sprintf("d8:announce3:foo4:info%se", info)
+		if _, err := DecodeTorrentFile([]byte(data)); err == nil {
+			t.Errorf("DecodeTorrentFile accepted path %q", c)
+		}
+	}
+}
+
+func TestAnnounceList(t *testing.T) {
+	info := "d6:lengthi1e4:name1:x12:piece lengthi1e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	cases := []struct {
+		data string
+		want [][]string
+	}{
+		{"d8:announce1:a4:info" + info + "e", [][]string{{"a"}}},
+		{"d8:announce1:a13:announce-listll1:b1:cel1:dee4:info" + info + "e", [][]string{{"b", "c"}, {"d"}}},
+		// Empty tiers and URLs are dropped; announce isn't needed with a list
+		{"d13:announce-listllel0:1:bee4:info" + info + "e", [][]string{{"b"}}},
+	}
+	for _, c := range cases {
+		tf, err := DecodeTorrentFile([]byte(c.data))
+		if err != nil {
+			t.Errorf("DecodeTorrentFile(%q) returned error %v", c.data, err)
+			continue
+		}
+		if got := tf.Tiers(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("DecodeTorrentFile(%q).Tiers() == %v, want %v", c.data, got, c.want)
+		}
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	pieces := "6:pieces20:" + strings.Repeat("x", 20)
+	cases := []struct {
+		info string
+		want bool
+	}{
+		{"d6:lengthi1e4:name1:x12:piece lengthi1e" + pieces + "e", false},
+		{"d6:lengthi1e4:name1:x12:piece lengthi1e" + pieces + "7:privatei1ee", true},
+		{"d6:lengthi1e4:name1:x12:piece lengthi1e" + pieces + "7:privatei0ee", false},
+	}
+	for _, c := range cases {
+		tf, err := DecodeTorrentFile([]byte("d8:announce1:a4:info" + c.info + "e"))
+		if err != nil {
+			t.Errorf("DecodeTorrentFile of info %q returned error %v", c.info, err)
+			continue
+		}
+		if tf.Info.Private != c.want {
+			t.Errorf("DecodeTorrentFile of info %q has Private %v, want %v", c.info, tf.Info.Private, c.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package tracker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// How long to wait before retrying after every tracker failed. The wait
+// doubles after each consecutive failure, up to maxRetryInterval.
+const (
+	minRetryInterval = 15 * time.Second
+	maxRetryInterval = 30 * time.Minute
+)
+
+// minAnnounceInterval is the least time between regular announces, whatever
+// interval the trackers ask for, so a broken tracker can't have us announcing
+// in a tight loop.
+const minAnnounceInterval = time.Minute
+
+// How long to spend telling the trackers we've stopped, once Run's context is
+// done
+const stopTimeout = 15 * time.Second
+
+// An Announcer keeps a torrent's trackers up to date over the course of a
+// download: it sends the started event when the download begins, re-announces
+// as often as the trackers ask, sends completed when the download finishes
+// and stopped when it's shut down.
+type Announcer struct {
+	// Client is used to contact the trackers. If nil, the Manager's default
+	// is used: a client like DefaultClient, but which retransmits to UDP
+	// trackers only once.
+	Client *Client
+
+	// NumWant is the number of peers to ask for in each announce. Zero means
+	// the trackers' default.
+	NumWant int
+
+	manager *Manager
+	stats   func() Stats
+	id      peer.ID
+	port    uint16
+	key     uint32
+
+	// minAnnounceInterval and minRetryInterval, but shorter in tests
+	minWait  time.Duration
+	minRetry time.Duration
+
+	completeOnce sync.Once
+	completed    chan struct{}
+}
+
+// NewAnnouncer returns an Announcer for tf's trackers, announcing with the
+// given peer id and listening port. stats is called before each announce for
+// the download's current transfer counters, so must be safe to call from
+// another goroutine.
+func NewAnnouncer(tf torrentfile.TorrentFile, id peer.ID, port uint16, stats func() Stats) (*Announcer, error) {
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Announcer{
+		manager:   NewManager(tf),
+		stats:     stats,
+		id:        id,
+		port:      port,
+		key:       key,
+		minWait:   minAnnounceInterval,
+		minRetry:  minRetryInterval,
+		completed: make(chan struct{}),
+	}, nil
+}
+
+// request returns a Request for event with our identity and current stats
+func (a *Announcer) request(event Event) Request {
+	return Request{
+		Event:   event,
+		Stats:   a.stats(),
+		PeerID:  a.id,
+		Port:    a.port,
+		Key:     a.key,
+		NumWant: a.NumWant,
+	}
+}
+
+// Completed tells the Announcer the download has finished, so it announces
+// the completed event straight away, or as soon as the trackers' min
+// interval allows. It may be called more than once, from any goroutine.
+func (a *Announcer) Completed() {
+	a.completeOnce.Do(func() { close(a.completed) })
+}
+
+// Manager returns the Manager used to contact the trackers, which peers can
+// use for tracker exchange.
+func (a *Announcer) Manager() *Manager {
+	return a.manager
+}
+
+// Run announces until ctx is done, passing the peers from each response to
+// onPeers. It then sends the stopped event, and returns any error doing so.
+// Trackers' warning messages are logged.
+func (a *Announcer) Run(ctx context.Context, onPeers func([]peer.Peer)) error {
+	a.manager.Client = a.Client
+
+	// No completed is sent if the download was complete when started
+	event := EventStarted
+	sendCompleted := a.stats().Left > 0
+
+	announced := false
+	pendingCompleted := false // Completed before started was delivered
+	var last time.Time
+	var minInterval time.Duration
+	retry := a.minRetry
+	completed := a.completed
+	for {
+		var wait time.Duration
+		res, err := a.manager.Announce(ctx, a.request(event))
+		if err != nil {
+			// Keep the event, so started or completed is retried
+			if ctx.Err() == nil {
+				log.Printf("Announce failed: %v", err)
+			}
+			wait = retry
+			if retry *= 2; retry > maxRetryInterval {
+				retry = maxRetryInterval
+			}
+		} else {
+			announced = true
+			last = time.Now()
+			event = EventNone
+			retry = a.minRetry
+			minInterval = res.MinInterval
+			wait = res.Interval
+			if wait < minInterval {
+				wait = minInterval
+			}
+			if wait < a.minWait {
+				wait = a.minWait
+			}
+			if pendingCompleted {
+				pendingCompleted = false
+				event = EventCompleted
+				wait = minInterval
+			}
+			if res.WarningMessage != "" {
+				log.Printf("Tracker warning: %v", res.WarningMessage)
+			}
+			onPeers(res.Peers)
+		}
+
+		timer := time.NewTimer(wait)
+	waiting:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return a.stop(announced, event, completed, sendCompleted)
+			case <-timer.C:
+				break waiting
+			case <-completed:
+				completed = nil // Only once
+				if !sendCompleted {
+					continue
+				}
+				if event == EventStarted {
+					// Completed follows once started is delivered
+					pendingCompleted = true
+					continue
+				}
+				event = EventCompleted
+				// Announce early, but no earlier than the trackers allow
+				timer.Stop()
+				timer = time.NewTimer(minInterval - time.Since(last))
+			}
+		}
+	}
+}
+
+// stop sends the stopped event, first sending completed if the download
+// finished but the trackers haven't yet been told.
+func (a *Announcer) stop(announced bool, event Event, completed chan struct{}, sendCompleted bool) error {
+	if !announced {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	select {
+	case <-completed:
+		if sendCompleted {
+			event = EventCompleted
+		}
+	default:
+	}
+	if event == EventCompleted {
+		if _, err := a.manager.Announce(ctx, a.request(EventCompleted)); err != nil {
+			return err
+		}
+	}
+	_, err := a.manager.Announce(ctx, a.request(EventStopped))
+	return err
+}
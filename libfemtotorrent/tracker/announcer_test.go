@@ -0,0 +1,167 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// runAnnouncer runs an Announcer against a fake tracker that asks for an
+// announce every few milliseconds, calling Completed after the first
+// response, and returns the events sent.
+func runAnnouncer(t *testing.T, left int64) []Event {
+	var mu sync.Mutex
+	var events []Event
+	a, err := NewAnnouncer(torrentfile.TorrentFile{Announce: "http://t"}, peer.ID{}, 6881, func() Stats {
+		return Stats{Left: left}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.minWait = time.Millisecond
+	a.manager.announce = func(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+		mu.Lock()
+		events = append(events, req.Event)
+		mu.Unlock()
+		return Response{Interval: 5 * time.Millisecond}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	responses := 0
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx, func([]peer.Peer) {
+			responses++
+			switch responses {
+			case 1:
+				a.Completed()
+			case 5:
+				cancel()
+			}
+		})
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return events
+}
+
+func TestAnnouncerEvents(t *testing.T) {
+	events := runAnnouncer(t, 100)
+	if len(events) != 6 || events[0] != EventStarted || events[5] != EventStopped {
+		t.Fatalf("Announcer sent events %v", events)
+	}
+	completed := 0
+	for _, e := range events[1:5] {
+		if e == EventCompleted {
+			completed++
+		} else if e != EventNone {
+			t.Errorf("Announcer sent events %v", events)
+		}
+	}
+	if completed != 1 {
+		t.Errorf("Announcer sent events %v, want one completed", events)
+	}
+}
+
+func TestAnnouncerAlreadyComplete(t *testing.T) {
+	// No completed event should be sent for a download that started complete
+	events := runAnnouncer(t, 0)
+	for _, e := range events {
+		if e == EventCompleted {
+			t.Errorf("Announcer sent events %v", events)
+		}
+	}
+}
+
+func TestAnnouncerCompletedThenStopped(t *testing.T) {
+	// Completing and stopping straight away should still send completed
+	var events []Event
+	a, err := NewAnnouncer(torrentfile.TorrentFile{Announce: "http://t"}, peer.ID{}, 6881, func() Stats {
+		return Stats{Left: 100}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.manager.announce = func(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+		events = append(events, req.Event)
+		return Response{Interval: time.Hour, MinInterval: time.Hour}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err = a.Run(ctx, func([]peer.Peer) {
+		a.Completed()
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Event{EventStarted, EventCompleted, EventStopped}; !reflect.DeepEqual(events, want) {
+		t.Errorf("Announcer sent events %v, want %v", events, want)
+	}
+}
+
+func TestAnnouncerCompletedBeforeStarted(t *testing.T) {
+	// If the download completes while started is still being retried,
+	// both should be sent, in order
+	var events []Event
+	a, err := NewAnnouncer(torrentfile.TorrentFile{Announce: "http://t"}, peer.ID{}, 6881, func() Stats {
+		return Stats{Left: 100}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.minRetry = time.Millisecond
+	a.manager.announce = func(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+		events = append(events, req.Event)
+		if len(events) == 1 {
+			a.Completed()
+			return Response{}, errors.New("connection refused")
+		}
+		return Response{Interval: time.Hour}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err = a.Run(ctx, func([]peer.Peer) {
+		if len(events) == 3 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Event{EventStarted, EventStarted, EventCompleted, EventStopped}; !reflect.DeepEqual(events, want) {
+		t.Errorf("Announcer sent events %v, want %v", events, want)
+	}
+}
+
+func TestAnnouncerZeroInterval(t *testing.T) {
+	// A tracker asking for announces constantly shouldn't get them
+	announces := 0
+	a, err := NewAnnouncer(torrentfile.TorrentFile{Announce: "http://t"}, peer.ID{}, 6881, func() Stats {
+		return Stats{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.minWait = 20 * time.Millisecond
+	a.manager.announce = func(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+		announces++
+		return Response{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Run(ctx, func([]peer.Peer) {}); err != nil {
+		t.Fatal(err)
+	}
+	// Up to three regular announces, and stopped
+	if announces > 4 {
+		t.Errorf("announced %v times in 50ms with a 20ms floor", announces)
+	}
+}
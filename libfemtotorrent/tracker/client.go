@@ -0,0 +1,113 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultUserAgent is the User-Agent sent to HTTP trackers by default.
+const DefaultUserAgent = "femtotorrent/0.0.1"
+
+// No tracker response should come anywhere near this size
+const maxResponseSize = 16 << 20
+
+// A Client makes requests to trackers. The zero value is ready to use.
+type Client struct {
+	// HTTPClient is used for http:// and https:// trackers, so can be used
+	// to configure timeouts and proxies. If nil, a client with a 30 second
+	// timeout is used.
+	HTTPClient *http.Client
+
+	// UDPClient is used for udp:// trackers. If nil, DefaultUDPClient is
+	// used.
+	UDPClient *UDPClient
+
+	// UserAgent is sent to HTTP trackers. If empty, DefaultUserAgent is
+	// sent.
+	UserAgent string
+}
+
+// DefaultClient is the Client used by GetPeers, Scrape and Managers without
+// one of their own.
+var DefaultClient = &Client{}
+
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return defaultHTTPClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) udpClient() *UDPClient {
+	if c.UDPClient == nil {
+		return DefaultUDPClient
+	}
+	return c.UDPClient
+}
+
+// A FailureError is a tracker's refusal of a request, with the reason it
+// gave.
+type FailureError struct {
+	Tracker string
+	Reason  string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker %v: Received failure from server: %v", e.Tracker, e.Reason)
+}
+
+// A StatusError is returned when an HTTP tracker responds with a status other
+// than 200 OK.
+type StatusError struct {
+	Tracker    string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("tracker %v: unexpected status %v", e.Tracker, e.Status)
+}
+
+// get fetches url from an HTTP tracker, and calls decode with the
+// (decompressed) response body.
+func (c *Client) get(ctx context.Context, tracker, url string, decode func(io.Reader) error) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	// Asking explicitly means we decompress it ourselves, whatever the
+	// HTTPClient's transport is configured to do.
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &StatusError{Tracker: tracker, StatusCode: res.StatusCode, Status: res.Status}
+	}
+
+	var body io.Reader = io.LimitReader(res.Body, maxResponseSize)
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxResponseSize)
+	}
+	return decode(body)
+}
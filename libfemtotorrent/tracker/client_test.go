@@ -0,0 +1,91 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+func TestClientHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "test/1.0" {
+			t.Errorf("sent User-Agent %q", ua)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("d8:intervali1800e5:peers0:15:warning message7:be nicee"))
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	c := &Client{HTTPClient: srv.Client(), UserAgent: "test/1.0"}
+	res, err := c.Announce(context.Background(), srv.URL+"/announce", torrentfile.TorrentFile{}, Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.WarningMessage != "be nice" {
+		t.Errorf("Announce().WarningMessage == %q", res.WarningMessage)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing/announce":
+			http.NotFound(w, r)
+		case "/failing/announce":
+			w.Write([]byte("d14:failure reason7:go awaye"))
+		}
+	}))
+	defer srv.Close()
+
+	_, err := DefaultClient.Announce(context.Background(), srv.URL+"/missing/announce", torrentfile.TorrentFile{}, Request{})
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusNotFound {
+		t.Errorf("Announce to missing tracker returned error %v", err)
+	}
+
+	_, err = DefaultClient.Announce(context.Background(), srv.URL+"/failing/announce", torrentfile.TorrentFile{}, Request{})
+	var ferr *FailureError
+	if !errors.As(err, &ferr) || ferr.Reason != "go away" {
+		t.Errorf("Announce to failing tracker returned error %v", err)
+	}
+
+	_, err = DefaultClient.Announce(context.Background(), "wss://example.com/announce", torrentfile.TorrentFile{}, Request{})
+	if err == nil {
+		t.Errorf("Announce to unsupported scheme returned no error")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	// Neither of these trackers will ever respond
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.drop = 1000
+	f.mu.Unlock()
+
+	for _, trackerURL := range []string{srv.URL + "/announce", "udp://" + f.addr()} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		_, err := DefaultClient.Announce(ctx, trackerURL, torrentfile.TorrentFile{}, Request{})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Announce(%v) returned error %v, want context.DeadlineExceeded", trackerURL, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Announce(%v) took %v to notice cancellation", trackerURL, elapsed)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// MaxLearnedTrackers caps how many trackers a Manager will accept from peers
+// over tracker exchange, so a hostile peer can't make us announce to an
+// unbounded number of hosts.
+const MaxLearnedTrackers = 50
+
+// DefaultTrackerTimeout is how long a Manager waits for each tracker to
+// respond before moving on to the next in its tier.
+const DefaultTrackerTimeout = time.Minute
+
+// managerClient is the Client used by Managers without one of their own. A
+// dead UDP tracker would otherwise have us retransmitting to it for the
+// better part of two hours, so it's given up on after one retry.
+var managerClient = &Client{UDPClient: &UDPClient{MaxRetries: 1}}
+
+// A Manager announces to a torrent's trackers, following the tier semantics
+// of BEP 12 (http://bittorrent.org/beps/bep_0012.html).
+//
+// Trackers within each tier are shuffled once, when the Manager is created.
+// On each announce, every tier is tried at once: its trackers are contacted in
+// order until one responds, and that tracker is moved to the front of its
+// tier so it's tried first next time. Peers from all tiers that responded are
+// merged, so a torrent whose primary tracker is down can still start.
+//
+// A Manager also implements peer.TrackerExchange: trackers learned from peers
+// are tried, as a final tier, from the next announce on, and only trackers
+// that have responded are advertised to peers.
+type Manager struct {
+	// Client is used to contact the trackers. If nil, a client like
+	// DefaultClient is used, but which retransmits to UDP trackers only
+	// once.
+	Client *Client
+
+	// TrackerTimeout bounds each attempt to contact a tracker. If zero,
+	// DefaultTrackerTimeout is used.
+	TrackerTimeout time.Duration
+
+	tf torrentfile.TorrentFile
+
+	// announce contacts a single tracker; swapped out in tests
+	announce func(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error)
+
+	mu          sync.Mutex
+	tiers       [][]string
+	trackerIDs  map[string]string // By tracker URL
+	learnedTier int               // Index into tiers, or -1 if none yet
+
+	// Tracker exchange happens on peer goroutines, and mustn't wait on mu
+	// while an announce is in progress.
+	texMu    sync.Mutex
+	known    map[string]bool // Every tracker we've seen, learned or not
+	learned  []string        // Learned since the last announce
+	nLearned int
+	verified []string // Trackers that have responded, in order
+}
+
+// NewManager returns a Manager for the trackers listed in tf.
+func NewManager(tf torrentfile.TorrentFile) *Manager {
+	m := &Manager{tf: tf, trackerIDs: make(map[string]string), learnedTier: -1, known: make(map[string]bool)}
+	for _, tier := range tf.Tiers() {
+		for _, u := range tier {
+			m.known[u] = true
+		}
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		m.tiers = append(m.tiers, shuffled)
+	}
+	return m
+}
+
+func (m *Manager) announceTo(ctx context.Context, trackerURL string, req Request) (Response, error) {
+	timeout := m.TrackerTimeout
+	if timeout == 0 {
+		timeout = DefaultTrackerTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if m.announce != nil {
+		return m.announce(ctx, trackerURL, m.tf, req)
+	}
+	client := m.Client
+	if client == nil {
+		client = managerClient
+	}
+	return client.Announce(ctx, trackerURL, m.tf, req)
+}
+
+// Tiers returns the trackers in the order they'll next be tried.
+func (m *Manager) Tiers() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tiers := make([][]string, len(m.tiers))
+	for i, tier := range m.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// VerifiedTrackers returns the trackers that have responded to an announce.
+func (m *Manager) VerifiedTrackers() []string {
+	m.texMu.Lock()
+	defer m.texMu.Unlock()
+	return append([]string(nil), m.verified...)
+}
+
+// AddTrackers adds trackers learned from a peer, to be tried from the next
+// announce on. Trackers already known, with unsupported schemes, or beyond
+// MaxLearnedTrackers are ignored, as are all trackers for private torrents.
+func (m *Manager) AddTrackers(urls []string) {
+	if !peer.SourceAllowed(m.tf, peer.SourceTEX) {
+		return
+	}
+	m.texMu.Lock()
+	defer m.texMu.Unlock()
+	for _, trackerURL := range urls {
+		if m.nLearned >= MaxLearnedTrackers {
+			return
+		}
+		if m.known[trackerURL] {
+			continue
+		}
+		u, err := url.Parse(trackerURL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		switch u.Scheme {
+		case "http", "https", "udp":
+		default:
+			continue
+		}
+		m.known[trackerURL] = true
+		m.learned = append(m.learned, trackerURL)
+		m.nLearned++
+	}
+}
+
+// takeLearned moves trackers learned since the last announce into the final
+// tier, which holds only learned trackers. Called with mu held.
+func (m *Manager) takeLearned() {
+	m.texMu.Lock()
+	learned := m.learned
+	m.learned = nil
+	m.texMu.Unlock()
+	if len(learned) == 0 {
+		return
+	}
+	if m.learnedTier < 0 {
+		m.learnedTier = len(m.tiers)
+		m.tiers = append(m.tiers, nil)
+	}
+	m.tiers[m.learnedTier] = append(m.tiers[m.learnedTier], learned...)
+}
+
+func (m *Manager) verify(trackerURL string) {
+	m.texMu.Lock()
+	defer m.texMu.Unlock()
+	for _, u := range m.verified {
+		if u == trackerURL {
+			return
+		}
+	}
+	m.verified = append(m.verified, trackerURL)
+}
+
+// An AnnounceError is returned when none of a torrent's trackers responded.
+// The errors from each tracker are kept, so errors.As can find, say, a
+// FailureError among them.
+type AnnounceError struct {
+	Errs []error // Each prefixed with the tracker's URL
+}
+
+func (e *AnnounceError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("all trackers failed: %v", strings.Join(msgs, "; "))
+}
+
+func (e *AnnounceError) Unwrap() []error {
+	return e.Errs
+}
+
+// Is and As look through Errs for errors.Is and errors.As, which only follow
+// Unwrap() []error themselves from Go 1.20.
+func (e *AnnounceError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *AnnounceError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// tierResult is the outcome of announcing to one tier.
+type tierResult struct {
+	trackerURL string // The tracker that responded, if any
+	res        Response
+	errs       []error
+}
+
+// announceTier tries the trackers in tier in order until one responds.
+// trackerIDs is only read.
+func (m *Manager) announceTier(ctx context.Context, tier []string, trackerIDs map[string]string, req Request) tierResult {
+	var r tierResult
+	for _, trackerURL := range tier {
+		if ctx.Err() != nil {
+			break
+		}
+		req.TrackerID = trackerIDs[trackerURL]
+		res, err := m.announceTo(ctx, trackerURL, req)
+		if err != nil {
+			r.errs = append(r.errs, fmt.Errorf("%v: %w", trackerURL, err))
+			continue
+		}
+		r.trackerURL, r.res = trackerURL, res
+		break
+	}
+	return r
+}
+
+// Announce announces to one tracker from each tier, and merges their
+// responses: Peers holds the peers they reported, without duplicates,
+// Interval is the shortest of their intervals and MinInterval the longest of
+// their minimum intervals. Tracker ids are remembered and sent back to each
+// tracker automatically, so req.TrackerID is ignored. Warning messages from
+// the trackers are combined. An error is returned only if no tracker at all
+// responded, or ctx is done.
+//
+// The tiers are announced to concurrently, each tracker being given
+// TrackerTimeout to respond, so one dead tracker can't hold up the rest.
+func (m *Manager) Announce(ctx context.Context, req Request) (Response, error) {
+	m.mu.Lock()
+	m.takeLearned()
+	tiers := make([][]string, len(m.tiers))
+	for i, tier := range m.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	trackerIDs := make(map[string]string, len(m.trackerIDs))
+	for u, id := range m.trackerIDs {
+		trackerIDs[u] = id
+	}
+	m.mu.Unlock()
+
+	results := make([]tierResult, len(tiers))
+	var wg sync.WaitGroup
+	for i, tier := range tiers {
+		wg.Add(1)
+		go func(i int, tier []string) {
+			defer wg.Done()
+			results[i] = m.announceTier(ctx, tier, trackerIDs, req)
+		}(i, tier)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var merged Response
+	seen := make(map[string]bool)
+	responded := false
+	var errs []error
+	var warnings []string
+	for i, r := range results {
+		errs = append(errs, r.errs...)
+		if r.trackerURL == "" {
+			continue
+		}
+		trackerURL, res := r.trackerURL, r.res
+		m.verify(trackerURL)
+		if res.TrackerID != "" {
+			m.trackerIDs[trackerURL] = res.TrackerID
+		}
+		if res.WarningMessage != "" {
+			warnings = append(warnings, fmt.Sprintf("%v: %v", trackerURL, res.WarningMessage))
+		}
+
+		// Promote the working tracker to the front of its tier
+		tier := m.tiers[i]
+		for j, u := range tier {
+			if u == trackerURL {
+				copy(tier[1:j+1], tier[:j])
+				tier[0] = trackerURL
+				break
+			}
+		}
+
+		for _, p := range res.Peers {
+			key := p.Addr()
+			if !seen[key] {
+				seen[key] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+		if !responded || res.Interval < merged.Interval {
+			merged.Interval = res.Interval
+		}
+		if res.MinInterval > merged.MinInterval {
+			merged.MinInterval = res.MinInterval
+		}
+		// The swarms the trackers know of overlap, so we can't add these
+		if res.Complete > merged.Complete {
+			merged.Complete = res.Complete
+		}
+		if res.Incomplete > merged.Incomplete {
+			merged.Incomplete = res.Incomplete
+		}
+		responded = true
+	}
+	if !responded {
+		return Response{}, &AnnounceError{Errs: errs}
+	}
+	merged.WarningMessage = strings.Join(warnings, "; ")
+	return merged, nil
+}
@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// fakeTrackers answers announces from a fixed table, recording which
+// trackers were contacted. Tiers are announced to concurrently, so only the
+// order within a tier is meaningful.
+type fakeTrackers struct {
+	responses map[string]Response // trackers missing from here fail
+	hang      map[string]bool     // trackers that never respond
+
+	mu        sync.Mutex
+	contacted []string
+	requests  map[string]Request
+}
+
+func (f *fakeTrackers) announce(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+	f.mu.Lock()
+	f.contacted = append(f.contacted, trackerURL)
+	if f.requests == nil {
+		f.requests = make(map[string]Request)
+	}
+	f.requests[trackerURL] = req
+	f.mu.Unlock()
+	if f.hang[trackerURL] {
+		<-ctx.Done()
+		return Response{}, ctx.Err()
+	}
+	res, ok := f.responses[trackerURL]
+	if !ok {
+		return Response{}, errors.New("connection refused")
+	}
+	return res, nil
+}
+
+func newTestManager(tiers [][]string, f *fakeTrackers) *Manager {
+	m := NewManager(torrentfile.TorrentFile{AnnounceList: tiers})
+	// Undo the shuffle, so tests are deterministic
+	m.tiers = nil
+	for _, tier := range tiers {
+		m.tiers = append(m.tiers, append([]string(nil), tier...))
+	}
+	m.announce = f.announce
+	return m
+}
+
+func TestManagerFailover(t *testing.T) {
+	a := peer.Peer{IPAddress: net.ParseIP("10.0.0.1"), Port: 6881}
+	b := peer.Peer{IPAddress: net.ParseIP("10.0.0.2"), Port: 6881}
+	f := &fakeTrackers{
+		responses: map[string]Response{
+			"http://t2": {Peers: []peer.Peer{a}, Interval: 1800 * time.Second, TrackerID: "xyz"},
+			"http://t3": {Peers: []peer.Peer{a, b}, Interval: 900 * time.Second, MinInterval: 60 * time.Second},
+		},
+	}
+	m := newTestManager([][]string{{"http://t1", "http://t2"}, {"http://t3"}}, f)
+
+	res, err := m.Announce(context.Background(), Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Response{Peers: []peer.Peer{a, b}, Interval: 900 * time.Second, MinInterval: 60 * time.Second}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Announce() == %+v, want %+v", res, want)
+	}
+	sort.Strings(f.contacted)
+	if want := []string{"http://t1", "http://t2", "http://t3"}; !reflect.DeepEqual(f.contacted, want) {
+		t.Errorf("contacted %v, want %v", f.contacted, want)
+	}
+
+	// t2 worked, so should now be tried before t1
+	if want := [][]string{{"http://t2", "http://t1"}, {"http://t3"}}; !reflect.DeepEqual(m.Tiers(), want) {
+		t.Errorf("Tiers() == %v, want %v", m.Tiers(), want)
+	}
+	f.contacted = nil
+	f.requests = nil
+	if _, err := m.Announce(context.Background(), Request{TrackerID: "ignored"}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(f.contacted)
+	if want := []string{"http://t2", "http://t3"}; !reflect.DeepEqual(f.contacted, want) {
+		t.Errorf("second announce contacted %v, want %v", f.contacted, want)
+	}
+	// Each tracker should get back its own tracker id
+	if f.requests["http://t2"].TrackerID != "xyz" || f.requests["http://t3"].TrackerID != "" {
+		t.Errorf("second announce sent requests %+v", f.requests)
+	}
+}
+
+func TestManagerTimeout(t *testing.T) {
+	a := peer.Peer{IPAddress: net.ParseIP("10.0.0.1"), Port: 6881}
+	f := &fakeTrackers{
+		responses: map[string]Response{
+			"http://t2": {Peers: []peer.Peer{a}, Interval: 1800 * time.Second},
+			"http://t3": {Interval: 900 * time.Second},
+		},
+		hang: map[string]bool{"http://t1": true},
+	}
+	m := newTestManager([][]string{{"http://t1", "http://t2"}, {"http://t3"}}, f)
+	m.TrackerTimeout = 50 * time.Millisecond
+
+	res, err := m.Announce(context.Background(), Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []peer.Peer{a}; !reflect.DeepEqual(res.Peers, want) {
+		t.Errorf("Announce() returned peers %v, want %v", res.Peers, want)
+	}
+	if want := [][]string{{"http://t2", "http://t1"}, {"http://t3"}}; !reflect.DeepEqual(m.Tiers(), want) {
+		t.Errorf("Tiers() == %v, want %v", m.Tiers(), want)
+	}
+}
+
+func TestManagerAllFail(t *testing.T) {
+	f := &fakeTrackers{}
+	m := newTestManager([][]string{{"http://t1"}, {"http://t2"}}, f)
+	if res, err := m.Announce(context.Background(), Request{}); err == nil {
+		t.Errorf("Announce() == %+v, want error", res)
+	}
+
+	// The trackers' own errors can be recovered
+	m.announce = func(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+		return Response{}, &FailureError{Tracker: trackerURL, Reason: "unregistered torrent"}
+	}
+	_, err := m.Announce(context.Background(), Request{})
+	var failure *FailureError
+	if !errors.As(err, &failure) || failure.Reason != "unregistered torrent" {
+		t.Errorf("Announce() returned %v, want a FailureError", err)
+	}
+	// Without relying on errors following Unwrap() []error
+	failure = nil
+	if aerr := (*AnnounceError)(nil); !errors.As(err, &aerr) || !aerr.As(&failure) || failure.Reason != "unregistered torrent" {
+		t.Errorf("AnnounceError.As found %v, want the FailureError", failure)
+	}
+}
+
+func TestManagerSingleAnnounce(t *testing.T) {
+	m := NewManager(torrentfile.TorrentFile{Announce: "http://only"})
+	if want := [][]string{{"http://only"}}; !reflect.DeepEqual(m.Tiers(), want) {
+		t.Errorf("Tiers() == %v, want %v", m.Tiers(), want)
+	}
+}
+
+func TestManagerTrackerExchange(t *testing.T) {
+	f := &fakeTrackers{
+		responses: map[string]Response{
+			"http://t1":         {Interval: 1800 * time.Second},
+			"http://learned/an": {Interval: 1800 * time.Second},
+		},
+	}
+	m := newTestManager([][]string{{"http://t1", "http://t2"}}, f)
+
+	if got := m.VerifiedTrackers(); got != nil {
+		t.Errorf("VerifiedTrackers() == %v before announcing", got)
+	}
+	m.AddTrackers([]string{"http://t2", "http://learned/an", "ftp://nope", "http://learned/an", "udp://"})
+	if _, err := m.Announce(context.Background(), Request{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"http://t1", "http://t2"}, {"http://learned/an"}}; !reflect.DeepEqual(m.Tiers(), want) {
+		t.Errorf("Tiers() == %v, want %v", m.Tiers(), want)
+	}
+	if want := []string{"http://t1", "http://learned/an"}; !reflect.DeepEqual(m.VerifiedTrackers(), want) {
+		t.Errorf("VerifiedTrackers() == %v, want %v", m.VerifiedTrackers(), want)
+	}
+
+	// Later trackers join the same tier, up to the limit
+	for i := 0; i < MaxLearnedTrackers; i++ {
+		m.AddTrackers([]string{fmt.Sprintf("udp://learned%d:6969", i)})
+	}
+	m.Announce(context.Background(), Request{})
+	if tiers := m.Tiers(); len(tiers) != 2 || len(tiers[1]) != MaxLearnedTrackers {
+		t.Errorf("Tiers() == %v, want %v learned trackers in the second tier", tiers, MaxLearnedTrackers)
+	}
+}
+
+func TestManagerTrackerExchangePrivate(t *testing.T) {
+	tf := torrentfile.TorrentFile{Announce: "http://t1"}
+	tf.Info.Private = true
+	m := NewManager(tf)
+	m.announce = (&fakeTrackers{}).announce
+	m.AddTrackers([]string{"http://learned/an"})
+	m.Announce(context.Background(), Request{})
+	if want := [][]string{{"http://t1"}}; !reflect.DeepEqual(m.Tiers(), want) {
+		t.Errorf("Tiers() == %v, want %v", m.Tiers(), want)
+	}
+}
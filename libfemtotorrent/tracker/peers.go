@@ -0,0 +1,105 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+)
+
+// peerList is the "peers" value of a tracker response. Trackers may send it
+// either as a list of dictionaries, as in the original spec, or as a single
+// string of packed addresses, as described by BEP 23
+// (http://bittorrent.org/beps/bep_0023.html).
+type peerList []peer.Peer
+
+func (l *peerList) UnmarshalBencode(data []byte) error {
+	*l = peerList{}
+	if len(data) > 0 && data[0] != 'l' {
+		var compact []byte
+		if err := bencoding.Unmarshal(data, &compact); err != nil {
+			return err
+		}
+		peers, err := parseCompactPeers(compact, net.IPv4len)
+		*l = peers
+		return err
+	}
+
+	var dicts []struct {
+		ID   []byte `bencode:"peer id"`
+		IP   string `bencode:"ip"`
+		Port uint16 `bencode:"port"`
+	}
+	if err := bencoding.Unmarshal(data, &dicts); err != nil {
+		return err
+	}
+	for _, p := range dicts {
+		if p.IP == "" {
+			return fmt.Errorf("ip not found in peer %+v", p)
+		}
+		if p.Port == 0 {
+			return fmt.Errorf("port not found in peer %+v", p)
+		}
+		// The spec allows a DNS name here too, but no tracker in the wild
+		// seems to send one, so rather than resolving we skip them.
+		ip := net.ParseIP(p.IP)
+		if ip == nil {
+			continue
+		}
+		*l = append(*l, peer.Peer{IPAddress: ip, Port: p.Port, ID: p.ID})
+	}
+	return nil
+}
+
+// peerList6 is the "peers6" value of a tracker response, a string of packed
+// IPv6 addresses as described by BEP 7
+// (http://bittorrent.org/beps/bep_0007.html).
+type peerList6 []peer.Peer
+
+func (l *peerList6) UnmarshalBencode(data []byte) error {
+	var compact []byte
+	if err := bencoding.Unmarshal(data, &compact); err != nil {
+		return err
+	}
+	peers, err := parseCompactPeers(compact, net.IPv6len)
+	*l = peers
+	return err
+}
+
+// parseCompactPeers splits b into addresses of ipLen bytes, each followed by a
+// two byte big-endian port.
+func parseCompactPeers(b []byte, ipLen int) ([]peer.Peer, error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("compact peers length %v is not a multiple of %v", len(b), size)
+	}
+	peers := make([]peer.Peer, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		// Copied, so the peers don't keep the whole response alive
+		ip := make(net.IP, ipLen)
+		copy(ip, b[i:i+ipLen])
+		peers = append(peers, peer.Peer{
+			IPAddress: ip,
+			Port:      binary.BigEndian.Uint16(b[i+ipLen : i+size]),
+		})
+	}
+	return peers, nil
+}
+
+// localIPv6 returns a global unicast IPv6 address of this machine, or nil if
+// it has none.
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+)
+
+// ScrapeStats describes the swarm for a single torrent.
+type ScrapeStats struct {
+	Complete   int    // Seeders
+	Downloaded int    // Number of times the torrent has been downloaded
+	Incomplete int    // Leechers
+	Name       string // Optional, and only sent by some HTTP trackers
+}
+
+// ScrapeURL derives a tracker's scrape URL from its announce URL, following
+// the convention described by BEP 48
+// (http://bittorrent.org/beps/bep_0048.html): the last path component must
+// start with "announce", which is replaced by "scrape". Trackers whose
+// announce URLs don't follow the convention don't support scraping.
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return "", fmt.Errorf("tracker %v does not support scraping", announceURL)
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	return u.String(), nil
+}
+
+// Scrape asks the tracker with the given announce URL for statistics about
+// the torrents with the given info hashes, using DefaultClient.
+func Scrape(ctx context.Context, announceURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+	return DefaultClient.Scrape(ctx, announceURL, infoHashes)
+}
+
+// Scrape asks the tracker with the given announce URL for statistics about
+// the torrents with the given info hashes, in as few requests as possible.
+// Torrents the tracker doesn't know about are missing from the result.
+func (c *Client) Scrape(ctx context.Context, announceURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		scrapeURL, err := ScrapeURL(announceURL)
+		if err != nil {
+			return nil, err
+		}
+		return c.scrapeHTTP(ctx, scrapeURL, infoHashes)
+	case "udp":
+		stats, err := c.udpClient().Scrape(ctx, u.Host, infoHashes)
+		if err != nil {
+			return nil, err
+		}
+		ret := make(map[[20]byte]ScrapeStats, len(stats))
+		for i, s := range stats {
+			ret[infoHashes[i]] = s
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+}
+
+func (c *Client) scrapeHTTP(ctx context.Context, scrapeURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeStats, error) {
+	q := url.Values{}
+	for _, h := range infoHashes {
+		q.Add("info_hash", string(h[:]))
+	}
+	var body struct {
+		FailureReason string `bencode:"failure reason"`
+		Files         map[string]struct {
+			Complete   int    `bencode:"complete"`
+			Downloaded int    `bencode:"downloaded"`
+			Incomplete int    `bencode:"incomplete"`
+			Name       string `bencode:"name"`
+		} `bencode:"files"`
+	}
+	err := c.get(ctx, scrapeURL, withQuery(scrapeURL, q), func(r io.Reader) error {
+		if err := bencoding.NewDecoder(r).Decode(&body); err != nil {
+			return fmt.Errorf("could not decode response: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if body.FailureReason != "" {
+		return nil, &FailureError{Tracker: scrapeURL, Reason: body.FailureReason}
+	}
+	if body.Files == nil {
+		return nil, fmt.Errorf("files not found in response %+v", body)
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(body.Files))
+	for hash, f := range body.Files {
+		if len(hash) != 20 {
+			return nil, fmt.Errorf("invalid info hash %x in response", hash)
+		}
+		var h [20]byte
+		copy(h[:], hash)
+		stats[h] = ScrapeStats{
+			Complete:   f.Complete,
+			Downloaded: f.Downloaded,
+			Incomplete: f.Incomplete,
+			Name:       f.Name,
+		}
+	}
+	return stats, nil
+}
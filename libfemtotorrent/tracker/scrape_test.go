@@ -0,0 +1,71 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+	}
+	for _, c := range cases {
+		got, err := ScrapeURL(c.in)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("ScrapeURL(%v) == %v, want error", c.in, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("ScrapeURL(%v) == %v, %v, want %v", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	a := [20]byte{'a'}
+	b := [20]byte{'b'}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		if hashes := r.URL.Query()["info_hash"]; !reflect.DeepEqual(hashes, []string{string(a[:]), string(b[:])}) {
+			t.Errorf("scrape requested info hashes %q", hashes)
+		}
+		w.Write([]byte("d5:filesd20:" + string(a[:]) + "d8:completei5e10:downloadedi50e10:incompletei10e4:name3:fooeee"))
+	}))
+	defer srv.Close()
+
+	got, err := Scrape(context.Background(), srv.URL+"/announce", [][20]byte{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[[20]byte]ScrapeStats{a: {Complete: 5, Downloaded: 50, Incomplete: 10, Name: "foo"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrape == %v, want %v", got, want)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	a := [20]byte{1, 2, 3}
+	got, err := Scrape(context.Background(), "udp://"+f.addr()+"/announce", [][20]byte{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[[20]byte]ScrapeStats{a: {Complete: 1, Downloaded: 2, Incomplete: 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrape == %v, want %v", got, want)
+	}
+}
@@ -1,19 +1,152 @@
 package tracker
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
 	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
 	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
 )
 
-// GetPeers retrieves a list of peers from the remote tracker
-// TODO: implement http://bittorrent.org/beps/bep_0023.html
-func GetPeers(tf torrentfile.TorrentFile) (peers []peer.Peer, interval int, err error) {
+// Event is the reason for an announce.
+type Event int
+
+// The values match those used by the UDP tracker protocol
+const (
+	EventNone      Event = iota // One of the announces made at regular intervals
+	EventCompleted              // The download has just finished
+	EventStarted                // The download is beginning
+	EventStopped                // We're shutting down
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// Stats are the transfer counters reported to trackers, in bytes.
+type Stats struct {
+	Uploaded   int64
+	Downloaded int64
+
+	// Left can't be computed from Downloaded and the torrent's length, as
+	// the download might be a resume, and some of the data might have failed
+	// an integrity check and had to be downloaded again.
+	Left int64
+}
+
+// A Request holds the parameters of an announce.
+type Request struct {
+	Event Event
+	Stats
+
+	// TrackerID is the tracker id from the tracker's previous response, if
+	// any.
+	TrackerID string
+
+	// These identify us, and should be the same for every announce in a
+	// session.
+	PeerID peer.ID
+	Port   uint16 // That we listen for incoming connections on
+	Key    uint32 // Lets trackers recognise us if our IP address changes
+
+	// NumWant is the number of peers we'd like. Zero means the tracker's
+	// default.
+	NumWant int
+}
+
+// NewKey returns a random key for use in announces.
+func NewKey() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// A Response is a tracker's reply to an announce.
+type Response struct {
+	Peers []peer.Peer
+
+	// Interval is how long to wait before announcing again. MinInterval, if
+	// set, is the least time to wait before announcing early.
+	Interval    time.Duration
+	MinInterval time.Duration
+
+	// TrackerID should be sent back with subsequent announces
+	TrackerID string
+
+	// WarningMessage is a message the tracker wants shown to the user, even
+	// though the announce succeeded.
+	WarningMessage string
+
+	// Seeders and leechers in the swarm, if the tracker says
+	Complete   int
+	Incomplete int
+}
+
+// GetPeers retrieves a list of peers from the torrent's trackers, announcing
+// with the given peer id and port. See Manager for how trackers are chosen
+// when there are several. interval is in seconds.
+func GetPeers(ctx context.Context, tf torrentfile.TorrentFile, id peer.ID, port uint16) (peers []peer.Peer, interval int, err error) {
+	req := Request{
+		Stats:  Stats{Left: tf.Info.TotalLength()},
+		PeerID: id,
+		Port:   port,
+	}
+	req.Key, err = NewKey()
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := NewManager(tf).Announce(ctx, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Peers, int(res.Interval / time.Second), nil
+}
+
+// withQuery adds q to the query string of trackerURL, which may already have
+// one, such as a private tracker's passkey.
+func withQuery(trackerURL string, q url.Values) string {
+	sep := "?"
+	if strings.Contains(trackerURL, "?") {
+		sep = "&"
+	}
+	return trackerURL + sep + q.Encode()
+}
+
+// Announce makes an announce to the tracker at trackerURL, using the
+// protocol given by its scheme.
+func (c *Client) Announce(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return Response{}, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return c.announceHTTP(ctx, trackerURL, tf, req)
+	case "udp":
+		return c.udpClient().Announce(ctx, u.Host, tf, req)
+	}
+	return Response{}, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+}
+
+// announceHTTP makes an announce to the HTTP tracker at trackerURL
+func (c *Client) announceHTTP(ctx context.Context, trackerURL string, tf torrentfile.TorrentFile, req Request) (Response, error) {
 	q := url.Values{}
 	// The 20 byte sha1 hash of the bencoded form of the info value
 	// from the metainfo file. This value will almost certainly have to be
@@ -30,27 +163,53 @@ func GetPeers(tf torrentfile.TorrentFile) (peers []peer.Peer, interval int, err
 	// peer_id A string of length 20 which this downloader uses as its id. Each
 	// downloader generates its own id at random at the start of a new download.
 	// This value will also almost certainly have to be escaped.
-	q.Add("peer_id", "chandlerswiftdebian!") // TODO
+	q.Add("peer_id", string(req.PeerID[:]))
 
 	// ip An optional parameter giving the IP (or dns name) which this peer is
 	// at. Generally used for the origin if it's on the same machine as the
 	// tracker.
 
+	// ipv6 Our IPv6 address, from BEP 7, so trackers contacted over IPv4 can
+	// still hand it out to IPv6 peers.
+	if ip := localIPv6(); ip != nil {
+		q.Add("ipv6", ip.String())
+	}
+
 	// port The port number this peer is listening on. Common behavior is for a
 	// downloader to try to listen on port 6881 and if that port is taken try
 	// 6882, then 6883, etc. and give up after 6889.
-	// TODO
+	q.Add("port", fmt.Sprint(req.Port))
 
 	// uploaded The total amount uploaded so far, encoded in base ten ascii.
-	q.Add("uploaded", "0")
+	q.Add("uploaded", fmt.Sprint(req.Uploaded))
 	// downloaded The total amount downloaded so far, encoded in base ten ascii.
-	q.Add("downloaded", "0")
+	q.Add("downloaded", fmt.Sprint(req.Downloaded))
 
 	// left The number of bytes this peer still has to download, encoded in base
 	// ten ascii. Note that this can't be computed from downloaded and the file
 	// length since it might be a resume, and there's a chance that some of the
 	// downloaded data failed an integrity check and had to be re-downloaded.
-	q.Add("left", fmt.Sprint(tf.Info.Length)) // TODO: multi-file case
+	q.Add("left", fmt.Sprint(req.Left))
+
+	// numwant Optional. Number of peers that the client would like to receive
+	// from the tracker. This value is permitted to be zero. If omitted,
+	// typically defaults to 50 peers.
+	if req.NumWant > 0 {
+		q.Add("numwant", fmt.Sprint(req.NumWant))
+	}
+
+	// key Optional. An additional identification that is not shared with any
+	// other peers. It is intended to allow a client to prove their identity
+	// should their IP address change.
+	q.Add("key", fmt.Sprintf("%08x", req.Key))
+
+	// no_peer_id Indicates that the tracker can omit the peer id field in the
+	// peers dictionary. Ignored if compact is honoured.
+	q.Add("no_peer_id", "1")
+
+	// compact Asks for the peer list in the compact form of BEP 23. Most
+	// trackers send it regardless.
+	q.Add("compact", "1")
 
 	// event This is an optional key which maps to started, completed, or
 	// stopped (or empty, which is the same as not being present). If not
@@ -59,54 +218,56 @@ func GetPeers(tf torrentfile.TorrentFile) (peers []peer.Peer, interval int, err
 	// using completed is sent when the download is complete. No completed is
 	// sent if the file was complete when started. Downloaders send an
 	// announcement using stopped when they cease downloading.
+	if req.Event != EventNone {
+		q.Add("event", req.Event.String())
+	}
 
-	res, err := http.Get(fmt.Sprintf("%v?%v", tf.Announce, q.Encode()))
-	if err != nil {
-		panic(err)
+	// trackerid If a previous announce contained a tracker id, it should be
+	// set here.
+	if req.TrackerID != "" {
+		q.Add("trackerid", req.TrackerID)
 	}
-	defer res.Body.Close()
-	rawBody, err := ioutil.ReadAll(res.Body)
+
+	var body struct {
+		Complete       int       `bencode:"complete"`
+		FailureReason  string    `bencode:"failure reason"`
+		Incomplete     int       `bencode:"incomplete"`
+		Interval       int       `bencode:"interval"`
+		MinInterval    int       `bencode:"min interval"`
+		Peers          peerList  `bencode:"peers"`
+		Peers6         peerList6 `bencode:"peers6"`
+		TrackerID      string    `bencode:"tracker id"`
+		WarningMessage string    `bencode:"warning message"`
+	}
+	err := c.get(ctx, trackerURL, withQuery(trackerURL, q), func(r io.Reader) error {
+		if err := bencoding.NewDecoder(r).Decode(&body); err != nil {
+			return fmt.Errorf("could not decode response: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return Response{}, err
 	}
-	untypedBody, err := bencoding.Decode(rawBody)
 
-	body, ok := untypedBody.(map[string]interface{})
-	if !ok {
-		return nil, 0, fmt.Errorf("body of response was unexpected type '%T', not map[string]interface{}", body)
+	if body.FailureReason != "" {
+		return Response{}, &FailureError{Tracker: trackerURL, Reason: body.FailureReason}
 	}
 
-	if failureReason, ok := body["failure reason"].([]byte); ok {
-		return nil, 0, fmt.Errorf("Received failure from server: %+v", string(failureReason))
+	if body.Interval <= 0 {
+		return Response{}, fmt.Errorf("interval not found in response %+v", body)
 	}
 
-	interval, ok = body["interval"].(int)
-	if !ok {
-		return nil, 0, fmt.Errorf("interval not found in response %+v", body)
+	if body.Peers == nil && body.Peers6 == nil {
+		return Response{}, fmt.Errorf("peers list not found in response %+v", body)
 	}
+	return Response{
+		Peers:       append(body.Peers, body.Peers6...),
+		Interval:    time.Duration(body.Interval) * time.Second,
+		MinInterval: time.Duration(body.MinInterval) * time.Second,
+		TrackerID:   body.TrackerID,
+		Complete:    body.Complete,
+		Incomplete:  body.Incomplete,
 
-	rawPeers, ok := body["peers"].([]interface{})
-	if !ok {
-		return nil, 0, fmt.Errorf("peers list not found in response %+v", body)
-	}
-	for _, rawPeer := range rawPeers {
-		p, ok := rawPeer.(map[string]interface{})
-		if ok {
-			ip, ok := p["ip"].([]byte)
-			if !ok {
-				return nil, 0, fmt.Errorf("ip not found in peer %+v", p)
-			}
-			port, ok := p["port"].(int)
-			if !ok {
-				return nil, 0, fmt.Errorf("port not found in peer %+v", p)
-			}
-			peers = append(peers, peer.Peer{
-				IPAddress: ip,
-				Port:      uint16(port),
-			})
-		} else {
-			return nil, 0, fmt.Errorf("peer was unexpected type '%T', not map[string]interface{}", p)
-		}
-	}
-	return
+		WarningMessage: body.WarningMessage,
+	}, nil
 }
@@ -0,0 +1,138 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+func TestAnnounce(t *testing.T) {
+	v4 := peer.Peer{IPAddress: net.IP{10, 0, 0, 1}, Port: 6881}
+	v6 := peer.Peer{IPAddress: net.ParseIP("2001:db8::1"), Port: 6882}
+	cases := []struct {
+		response string
+		want     []peer.Peer
+	}{
+		// Dictionary form
+		{"d8:intervali1800e5:peersld2:ip8:10.0.0.17:peer id20:-FT0001-abcdefghijkl4:porti6881eeee", []peer.Peer{{IPAddress: net.ParseIP("10.0.0.1"), Port: 6881, ID: []byte("-FT0001-abcdefghijkl")}}},
+		// Compact form
+		{"d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e", []peer.Peer{v4}},
+		// Compact IPv4 and IPv6
+		{"d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e", []peer.Peer{v4, v6}},
+		// IPv6 only
+		{"d8:intervali1800e6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e", []peer.Peer{v6}},
+		// No peers at all is fine
+		{"d8:intervali1800e5:peers0:e", []peer.Peer{}},
+	}
+	for _, c := range cases {
+		var query string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.RawQuery
+			w.Write([]byte(c.response))
+		}))
+		res, err := DefaultClient.announceHTTP(context.Background(), srv.URL, torrentfile.TorrentFile{}, Request{})
+		srv.Close()
+		if err != nil {
+			t.Errorf("announceHTTP of response %q returned error %v", c.response, err)
+			continue
+		}
+		if res.Interval != 1800*time.Second {
+			t.Errorf("announceHTTP of response %q returned interval %v", c.response, res.Interval)
+		}
+		if !reflect.DeepEqual(res.Peers, c.want) {
+			t.Errorf("announceHTTP of response %q returned peers %v, want %v", c.response, res.Peers, c.want)
+		}
+		if q, _ := url.ParseQuery(query); q.Get("compact") != "1" {
+			t.Errorf("announceHTTP sent query %q, want compact=1", query)
+		}
+	}
+}
+
+func TestAnnounceErrors(t *testing.T) {
+	cases := []string{
+		"d14:failure reason7:go awaye",
+		"d5:peers0:e",
+		"d8:intervali1800ee",
+		"d8:intervali1800e5:peers5:\x0a\x00\x00\x01\x1ae",
+		"d8:intervali1800e5:peersld2:ip8:10.0.0.1eee",
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(c))
+		}))
+		res, err := DefaultClient.announceHTTP(context.Background(), srv.URL, torrentfile.TorrentFile{}, Request{})
+		srv.Close()
+		if err == nil {
+			t.Errorf("announceHTTP of response %q == %+v, want error", c, res)
+		}
+	}
+}
+
+func TestAnnounceRequest(t *testing.T) {
+	var q url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q = r.URL.Query()
+		w.Write([]byte("d8:completei3e10:incompletei4e8:intervali1800e12:min intervali60e5:peers0:10:tracker id3:abce"))
+	}))
+	defer srv.Close()
+
+	req := Request{
+		Event:     EventStarted,
+		Stats:     Stats{Uploaded: 1, Downloaded: 2, Left: 3},
+		TrackerID: "xyz",
+		PeerID:    peer.ID{'-', 'F', 'T'},
+		Port:      6882,
+		Key:       0xdeadbeef,
+		NumWant:   10,
+	}
+	res, err := DefaultClient.announceHTTP(context.Background(), srv.URL, torrentfile.TorrentFile{}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Response{Peers: []peer.Peer{}, Interval: 1800 * time.Second, MinInterval: 60 * time.Second, TrackerID: "abc", Complete: 3, Incomplete: 4}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("announceHTTP == %+v, want %+v", res, want)
+	}
+	params := map[string]string{
+		"event":      "started",
+		"uploaded":   "1",
+		"downloaded": "2",
+		"left":       "3",
+		"trackerid":  "xyz",
+		"peer_id":    string(req.PeerID[:]),
+		"port":       "6882",
+		"key":        "deadbeef",
+		"numwant":    "10",
+		"no_peer_id": "1",
+		"compact":    "1",
+	}
+	for k, v := range params {
+		if q.Get(k) != v {
+			t.Errorf("announceHTTP sent %v=%q, want %q", k, q.Get(k), v)
+		}
+	}
+}
+
+func TestAnnouncePasskey(t *testing.T) {
+	var q url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q = r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	if _, err := DefaultClient.announceHTTP(context.Background(), srv.URL+"/announce?passkey=abc123", torrentfile.TorrentFile{}, Request{Port: 6882}); err != nil {
+		t.Fatal(err)
+	}
+	if q.Get("passkey") != "abc123" || q.Get("port") != "6882" {
+		t.Errorf("announceHTTP sent query %v, want the passkey and port", q)
+	}
+}
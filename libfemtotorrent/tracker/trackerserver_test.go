@@ -0,0 +1,71 @@
+package tracker_test
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/trackerserver"
+)
+
+// TestTrackerServer runs the client against a real tracker, serving HTTP and
+// UDP from the same store.
+func TestTrackerServer(t *testing.T) {
+	store := trackerserver.NewMemoryStore(time.Hour)
+	httpSrv := httptest.NewServer(&trackerserver.Server{Store: store, Interval: time.Minute})
+	defer httpSrv.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go (&trackerserver.UDPServer{Store: store, Interval: 2 * time.Minute}).Serve(conn)
+
+	httpURL := httpSrv.URL + "/announce?passkey=abc"
+	udpURL := "udp://" + conn.LocalAddr().String()
+	tf := torrentfile.TorrentFile{
+		InfoHash:     [20]byte{1, 2, 3},
+		AnnounceList: [][]string{{httpURL}, {udpURL}},
+	}
+	client := &tracker.Client{UDPClient: &tracker.UDPClient{BaseTimeout: 100 * time.Millisecond, MaxRetries: 2}}
+	ctx := context.Background()
+
+	announce := func(port uint16, left int64, event tracker.Event) tracker.Response {
+		t.Helper()
+		id, err := peer.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := tracker.NewManager(tf)
+		m.Client = client
+		res, err := m.Announce(ctx, tracker.Request{Event: event, Stats: tracker.Stats{Left: left}, PeerID: id, Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	announce(1000, 0, tracker.EventStarted)
+	res := announce(2000, 10, tracker.EventStarted)
+	// Both trackers know of the seeder, but it's only listed once
+	if len(res.Peers) != 1 || res.Peers[0].Port != 1000 {
+		t.Errorf("Announce returned peers %v, want the seeder", res.Peers)
+	}
+	if res.Interval != time.Minute || res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("Announce == %+v", res)
+	}
+
+	for _, u := range []string{httpURL, udpURL} {
+		stats, err := client.Scrape(ctx, u, [][20]byte{tf.InfoHash})
+		if err != nil {
+			t.Fatalf("scraping %v: %v", u, err)
+		}
+		if want := (tracker.ScrapeStats{Complete: 1, Incomplete: 1}); stats[tf.InfoHash] != want {
+			t.Errorf("scraping %v returned %+v, want %+v", u, stats[tf.InfoHash], want)
+		}
+	}
+}
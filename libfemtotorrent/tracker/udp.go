@@ -0,0 +1,305 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/internal/udptracker"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// A connection ID may be used for a minute after it's received
+const udpConnectionIDLifetime = time.Minute
+
+// A UDPClient talks to trackers using the UDP tracker protocol of BEP 15
+// (http://bittorrent.org/beps/bep_0015.html). It caches connection IDs, so
+// should be reused for repeated requests. The zero value is ready to use.
+type UDPClient struct {
+	// BaseTimeout is how long to wait for the first response. Following the
+	// spec, the wait doubles on each retransmission. Zero means 15 seconds.
+	BaseTimeout time.Duration
+
+	// MaxRetries is the number of retransmissions before giving up,
+	// counting connect requests and the request itself together. Zero means
+	// 8, the spec's limit, after which the client will have waited about two
+	// hours in total.
+	MaxRetries int
+
+	mu      sync.Mutex
+	connIDs map[string]udpConnectionID
+}
+
+type udpConnectionID struct {
+	id       uint64
+	received time.Time
+}
+
+// DefaultUDPClient is the UDPClient used for udp:// trackers by GetPeers.
+var DefaultUDPClient = &UDPClient{}
+
+// ErrTimeout is returned when a UDP tracker doesn't respond, even after
+// retransmission.
+var ErrTimeout = errors.New("timed out waiting for response")
+
+func (c *UDPClient) timeout(n int) time.Duration {
+	base := c.BaseTimeout
+	if base == 0 {
+		base = 15 * time.Second
+	}
+	return base << n
+}
+
+func (c *UDPClient) maxRetries() int {
+	if c.MaxRetries == 0 {
+		return 8
+	}
+	return c.MaxRetries
+}
+
+func newTransactionID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// exchange sends req on conn and waits up to timeout for a response to
+// transaction tid, ignoring any stray packets. A response with the error
+// action is returned as a *FailureError.
+func exchange(ctx context.Context, conn net.Conn, req []byte, tid uint32, action uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	// Checked after setting the deadline, so we can't miss request's
+	// watcher interrupting the read
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, ErrTimeout
+		} else if err != nil {
+			return nil, err
+		}
+		res := buf[:n]
+		if len(res) < 8 || binary.BigEndian.Uint32(res[4:8]) != tid {
+			continue // Not ours
+		}
+		switch binary.BigEndian.Uint32(res[0:4]) {
+		case action:
+			return res, nil
+		case udptracker.ActionError:
+			return nil, &FailureError{Tracker: "udp://" + conn.RemoteAddr().String(), Reason: string(res[8:])}
+		default:
+			return nil, fmt.Errorf("unexpected action %v in response", binary.BigEndian.Uint32(res[0:4]))
+		}
+	}
+}
+
+// connectionID returns a valid connection ID for the tracker at conn, either
+// from the cache, or by sending a single connect request and waiting up to
+// timeout for the response. fresh reports which.
+func (c *UDPClient) connectionID(ctx context.Context, conn net.Conn, addr string, timeout time.Duration) (id uint64, fresh bool, err error) {
+	c.mu.Lock()
+	cached, ok := c.connIDs[addr]
+	c.mu.Unlock()
+	if ok && time.Since(cached.received) < udpConnectionIDLifetime {
+		return cached.id, false, nil
+	}
+
+	tid, err := newTransactionID()
+	if err != nil {
+		return 0, false, err
+	}
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udptracker.ProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udptracker.ActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	res, err := exchange(ctx, conn, req, tid, udptracker.ActionConnect, timeout)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(res) < 16 {
+		return 0, false, fmt.Errorf("connect response too short (%v bytes)", len(res))
+	}
+	id = binary.BigEndian.Uint64(res[8:16])
+	c.mu.Lock()
+	if c.connIDs == nil {
+		c.connIDs = make(map[string]udpConnectionID)
+	}
+	c.connIDs[addr] = udpConnectionID{id: id, received: time.Now()}
+	c.mu.Unlock()
+	return id, true, nil
+}
+
+// forget drops the cached connection ID for addr.
+func (c *UDPClient) forget(addr string) {
+	c.mu.Lock()
+	delete(c.connIDs, addr)
+	c.mu.Unlock()
+}
+
+// request sends the request built by build to the tracker at addr,
+// retransmitting as the spec describes, and returns the response. build is
+// called afresh for each attempt, as the connection ID may have expired and
+// been renewed in between.
+//
+// The connect and the request itself share one schedule of retransmissions:
+// each packet that goes unanswered doubles the wait for the next, whichever
+// kind it was. An error response to a request made with a cached connection
+// ID may just mean the tracker has forgotten it, so the request is made once
+// more with a fresh one.
+func (c *UDPClient) request(ctx context.Context, addr string, action uint32, build func(connID uint64, tid uint32) []byte) (res []byte, remote *net.UDPAddr, err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	remote = conn.RemoteAddr().(*net.UDPAddr)
+
+	// Interrupt any read in progress if ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	for n := 0; n <= c.maxRetries(); {
+		connID, fresh, err := c.connectionID(ctx, conn, addr, c.timeout(n))
+		if err == ErrTimeout {
+			n++
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		tid, err := newTransactionID()
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err = exchange(ctx, conn, build(connID, tid), tid, action, c.timeout(n))
+		if err == ErrTimeout {
+			n++
+			continue
+		}
+		var failure *FailureError
+		if errors.As(err, &failure) {
+			c.forget(addr)
+			if !fresh {
+				continue
+			}
+		}
+		return res, remote, err
+	}
+	return nil, nil, fmt.Errorf("%v: %w", addr, ErrTimeout)
+}
+
+// Announce makes an announce to the UDP tracker at addr, given in host:port
+// form. UDP trackers don't use tracker ids, so req.TrackerID is ignored.
+func (c *UDPClient) Announce(ctx context.Context, addr string, tf torrentfile.TorrentFile, req Request) (Response, error) {
+	res, remote, err := c.request(ctx, addr, udptracker.ActionAnnounce, func(connID uint64, tid uint32) []byte {
+		b := make([]byte, 98)
+		binary.BigEndian.PutUint64(b[0:8], connID)
+		binary.BigEndian.PutUint32(b[8:12], udptracker.ActionAnnounce)
+		binary.BigEndian.PutUint32(b[12:16], tid)
+		copy(b[16:36], tf.InfoHash[:])
+		copy(b[36:56], req.PeerID[:])
+		binary.BigEndian.PutUint64(b[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(b[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(b[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(b[80:84], uint32(req.Event))
+		binary.BigEndian.PutUint32(b[84:88], 0) // IP: the sender's
+		binary.BigEndian.PutUint32(b[88:92], req.Key)
+		numWant := int32(-1) // The tracker's default
+		if req.NumWant > 0 {
+			numWant = int32(req.NumWant)
+		}
+		binary.BigEndian.PutUint32(b[92:96], uint32(numWant))
+		binary.BigEndian.PutUint16(b[96:98], req.Port)
+		return b
+	})
+	if err != nil {
+		return Response{}, err
+	}
+	if len(res) < 20 {
+		return Response{}, fmt.Errorf("announce response too short (%v bytes)", len(res))
+	}
+	interval := binary.BigEndian.Uint32(res[8:12])
+	if interval == 0 {
+		return Response{}, errors.New("announce response has interval 0")
+	}
+
+	// Trackers reached over IPv6 send IPv6 peers
+	ipLen := net.IPv4len
+	if remote.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := parseCompactPeers(res[20:], ipLen)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{
+		Peers:      peers,
+		Interval:   time.Duration(interval) * time.Second,
+		Incomplete: int(binary.BigEndian.Uint32(res[12:16])),
+		Complete:   int(binary.BigEndian.Uint32(res[16:20])),
+	}, nil
+}
+
+// Scrape asks the UDP tracker at addr for statistics about the torrents with
+// the given info hashes. The results are in the same order as infoHashes.
+func (c *UDPClient) Scrape(ctx context.Context, addr string, infoHashes [][20]byte) ([]ScrapeStats, error) {
+	var stats []ScrapeStats
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > udptracker.MaxScrape {
+			batch = batch[:udptracker.MaxScrape]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		res, _, err := c.request(ctx, addr, udptracker.ActionScrape, func(connID uint64, tid uint32) []byte {
+			req := make([]byte, 16, 16+20*len(batch))
+			binary.BigEndian.PutUint64(req[0:8], connID)
+			binary.BigEndian.PutUint32(req[8:12], udptracker.ActionScrape)
+			binary.BigEndian.PutUint32(req[12:16], tid)
+			for _, h := range batch {
+				req = append(req, h[:]...)
+			}
+			return req
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(res) < 8+12*len(batch) {
+			return nil, fmt.Errorf("scrape response too short (%v bytes for %v torrents)", len(res), len(batch))
+		}
+		for i := range batch {
+			b := res[8+12*i:]
+			stats = append(stats, ScrapeStats{
+				Complete:   int(binary.BigEndian.Uint32(b[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(b[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(b[8:12])),
+			})
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,266 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/internal/udptracker"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+)
+
+// fakeUDPTracker is a minimal in-process BEP 15 tracker.
+type fakeUDPTracker struct {
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	drop     int // Number of incoming packets to ignore, to test retransmission
+	packets  int // Number of incoming packets, including those dropped
+	connects int
+	fail     string // If set, every announce fails with this message
+	noWait   bool   // If set, announces are answered with interval 0
+	announce []byte // The last announce request
+}
+
+const fakeConnID = 0x0123456789abcdef
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUDPTracker{conn: conn}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+	return f
+}
+
+func (f *fakeUDPTracker) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+
+		f.mu.Lock()
+		f.packets++
+		if f.drop > 0 {
+			f.drop--
+			f.mu.Unlock()
+			continue
+		}
+		res := f.handle(req)
+		f.mu.Unlock()
+
+		if res != nil {
+			f.conn.WriteTo(res, addr)
+		}
+	}
+}
+
+func (f *fakeUDPTracker) handle(req []byte) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	action := binary.BigEndian.Uint32(req[8:12])
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint32(res[0:4], action)
+	copy(res[4:8], req[12:16])
+
+	if action == udptracker.ActionConnect {
+		if binary.BigEndian.Uint64(req[0:8]) != udptracker.ProtocolID {
+			return nil
+		}
+		f.connects++
+		return udptracker.AppendUint64(res, fakeConnID)
+	}
+	if binary.BigEndian.Uint64(req[0:8]) != fakeConnID {
+		binary.BigEndian.PutUint32(res[0:4], udptracker.ActionError)
+		return append(res, "invalid connection id"...)
+	}
+	switch action {
+	case udptracker.ActionAnnounce:
+		f.announce = append([]byte(nil), req...)
+		if f.fail != "" {
+			binary.BigEndian.PutUint32(res[0:4], udptracker.ActionError)
+			return append(res, f.fail...)
+		}
+		if f.noWait {
+			res = udptracker.AppendUint32(res, 0)
+		} else {
+			res = udptracker.AppendUint32(res, 1800) // interval
+		}
+		res = udptracker.AppendUint32(res, 1) // leechers
+		res = udptracker.AppendUint32(res, 2) // seeders
+		return append(res, 10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+	case udptracker.ActionScrape:
+		for i := 16; i+20 <= len(req); i += 20 {
+			// Seeders, completed and leechers derived from the hash
+			res = udptracker.AppendUint32(res, uint32(req[i]))
+			res = udptracker.AppendUint32(res, uint32(req[i+1]))
+			res = udptracker.AppendUint32(res, uint32(req[i+2]))
+		}
+		return res
+	}
+	return nil
+}
+
+func TestUDPAnnounceZeroInterval(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.noWait = true
+	f.mu.Unlock()
+	c := &UDPClient{BaseTimeout: 20 * time.Millisecond}
+	if res, err := c.Announce(context.Background(), f.addr(), torrentfile.TorrentFile{}, Request{}); err == nil {
+		t.Errorf("Announce == %+v, want error for interval 0", res)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	c := &UDPClient{BaseTimeout: 20 * time.Millisecond}
+	tf := torrentfile.TorrentFile{InfoHash: [20]byte{1, 2, 3}}
+	tf.Info.Length = 12345
+
+	id, err := peer.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Announce(context.Background(), f.addr(), tf, Request{Event: EventCompleted, Stats: Stats{Left: 12345}, PeerID: id, Port: 6881, Key: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Response{
+		Peers: []peer.Peer{
+			{IPAddress: net.IP{10, 0, 0, 1}, Port: 6881},
+			{IPAddress: net.IP{10, 0, 0, 2}, Port: 6882},
+		},
+		Interval:   1800 * time.Second,
+		Incomplete: 1,
+		Complete:   2,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Announce == %+v, want %+v", res, want)
+	}
+	f.mu.Lock()
+	req := f.announce
+	f.mu.Unlock()
+	if len(req) != 98 || !bytes.Equal(req[16:36], tf.InfoHash[:]) || binary.BigEndian.Uint64(req[64:72]) != 12345 || binary.BigEndian.Uint32(req[80:84]) != 1 ||
+		!bytes.Equal(req[36:56], id[:]) || binary.BigEndian.Uint32(req[88:92]) != 7 || int32(binary.BigEndian.Uint32(req[92:96])) != -1 || binary.BigEndian.Uint16(req[96:98]) != 6881 {
+		t.Errorf("Announce sent %x", req)
+	}
+
+	// The connection ID should be reused for a second announce
+	if _, err := c.Announce(context.Background(), f.addr(), tf, Request{}); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	connects := f.connects
+	f.mu.Unlock()
+	if connects != 1 {
+		t.Errorf("connected %v times, want 1", connects)
+	}
+
+	// udp:// URLs should be routed here
+	if res, err := DefaultClient.Announce(context.Background(), "udp://"+f.addr()+"/announce", tf, Request{}); err != nil || len(res.Peers) != 2 {
+		t.Errorf("announce(udp://...) == %+v, %v", res, err)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.drop = 3 // Two connects, then an announce
+	f.mu.Unlock()
+	c := &UDPClient{BaseTimeout: 10 * time.Millisecond}
+	if _, err := c.Announce(context.Background(), f.addr(), torrentfile.TorrentFile{}, Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.drop = 1000
+	f.mu.Unlock()
+	c = &UDPClient{BaseTimeout: time.Millisecond, MaxRetries: 2}
+	if _, err := c.Announce(context.Background(), f.addr(), torrentfile.TorrentFile{}, Request{}); err == nil {
+		t.Errorf("Announce to unresponsive tracker returned no error")
+	}
+}
+
+func TestUDPRetransmitSchedule(t *testing.T) {
+	// Connect and announce share one count of retransmissions
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.drop = 1000
+	f.mu.Unlock()
+	c := &UDPClient{BaseTimeout: time.Millisecond, MaxRetries: 3}
+	if _, err := c.Announce(context.Background(), f.addr(), torrentfile.TorrentFile{}, Request{}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Announce returned error %v, want ErrTimeout", err)
+	}
+	time.Sleep(10 * time.Millisecond) // For the last packet to arrive
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.packets != 4 {
+		t.Errorf("tracker received %v packets, want 4", f.packets)
+	}
+}
+
+func TestUDPStaleConnectionID(t *testing.T) {
+	// A tracker that's forgotten our connection ID gets a fresh one
+	f := newFakeUDPTracker(t)
+	c := &UDPClient{BaseTimeout: 20 * time.Millisecond}
+	c.connIDs = map[string]udpConnectionID{f.addr(): {id: 42, received: time.Now()}}
+	if _, err := c.Announce(context.Background(), f.addr(), torrentfile.TorrentFile{}, Request{}); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connects != 1 {
+		t.Errorf("%v connects, want 1", f.connects)
+	}
+}
+
+func TestUDPError(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.fail = "torrent not registered"
+	f.mu.Unlock()
+	c := &UDPClient{BaseTimeout: 20 * time.Millisecond}
+	_, err := c.Announce(context.Background(), f.addr(), torrentfile.TorrentFile{}, Request{})
+	var ferr *FailureError
+	if !errors.As(err, &ferr) || ferr.Reason != "torrent not registered" {
+		t.Errorf("Announce returned error %v", err)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	c := &UDPClient{BaseTimeout: 20 * time.Millisecond}
+
+	// More than fit in one packet
+	var hashes [][20]byte
+	var want []ScrapeStats
+	for i := 0; i < 100; i++ {
+		hashes = append(hashes, [20]byte{byte(i), byte(i + 1), byte(i + 2)})
+		want = append(want, ScrapeStats{Complete: i, Downloaded: i + 1, Incomplete: i + 2})
+	}
+	got, err := c.Scrape(context.Background(), f.addr(), hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrape == %v, want %v", got, want)
+	}
+}
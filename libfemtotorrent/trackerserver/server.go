@@ -0,0 +1,243 @@
+// Package trackerserver implements a BitTorrent tracker, serving the HTTP
+// announce and scrape endpoints of BEP 3, 23 and 48, and the UDP tracker
+// protocol of BEP 15.
+package trackerserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+// Defaults for a Server's zero fields
+const (
+	DefaultInterval = 30 * time.Minute
+	DefaultNumWant  = 50
+	MaxNumWant      = 200
+)
+
+// A Server is an HTTP tracker. Its announce and scrape endpoints are any path
+// whose last component starts with "announce" or "scrape" respectively, so
+// clients can derive one from the other.
+type Server struct {
+	// Store holds the swarms. It must be set, and may be shared with a
+	// UDPServer.
+	Store Store
+
+	// Interval is how often clients are asked to announce. MinInterval, if
+	// set, is the least time they may leave between announces.
+	Interval    time.Duration
+	MinInterval time.Duration
+
+	// Allowed, if not nil, restricts the tracker to the torrents with these
+	// info hashes.
+	Allowed map[[20]byte]bool
+}
+
+func (s *Server) interval() time.Duration {
+	if s.Interval == 0 {
+		return DefaultInterval
+	}
+	return s.Interval
+}
+
+func (s *Server) allowed(infoHash [20]byte) bool {
+	return s.Allowed == nil || s.Allowed[infoHash]
+}
+
+// numWant clamps a client's numwant to something reasonable. Negative means
+// the client didn't say.
+func numWant(n int) int {
+	if n < 0 {
+		return DefaultNumWant
+	}
+	if n > MaxNumWant {
+		return MaxNumWant
+	}
+	return n
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	last := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+	var res interface{}
+	var err error
+	switch {
+	case strings.HasPrefix(last, "announce"):
+		res, err = s.announce(r)
+	case strings.HasPrefix(last, "scrape"):
+		res, err = s.scrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		// Failures are reported in the body, not with the status code
+		res = map[string]string{"failure reason": err.Error()}
+	}
+	b, err := bencoding.Marshal(res)
+	if err != nil {
+		log.Printf("Encoding tracker response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+// queryInt parses an optional integer parameter
+func queryInt(q map[string][]string, key string, def int64) (int64, error) {
+	v, ok := q[key]
+	if !ok || len(v) == 0 {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v", key)
+	}
+	return i, nil
+}
+
+// queryHash parses a 20 byte parameter, such as info_hash
+func queryHash(value, key string) (h [20]byte, err error) {
+	if len(value) != len(h) {
+		return h, fmt.Errorf("invalid %v", key)
+	}
+	copy(h[:], value)
+	return h, nil
+}
+
+func (s *Server) announce(r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	var a Announce
+	var err error
+	if a.InfoHash, err = queryHash(q.Get("info_hash"), "info_hash"); err != nil {
+		return nil, err
+	}
+	if !s.allowed(a.InfoHash) {
+		return nil, fmt.Errorf("torrent not allowed on this tracker")
+	}
+	if a.PeerID, err = queryHash(q.Get("peer_id"), "peer_id"); err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	a.Port = uint16(port)
+	if a.Uploaded, err = queryInt(q, "uploaded", 0); err != nil {
+		return nil, err
+	}
+	if a.Downloaded, err = queryInt(q, "downloaded", 0); err != nil {
+		return nil, err
+	}
+	// A client that doesn't say how much it has left is assumed to be
+	// leeching
+	if a.Left, err = queryInt(q, "left", -1); err != nil {
+		return nil, err
+	}
+	switch q.Get("event") {
+	case "":
+	case "started":
+		a.Event = tracker.EventStarted
+	case "completed":
+		a.Event = tracker.EventCompleted
+	case "stopped":
+		a.Event = tracker.EventStopped
+	default:
+		return nil, fmt.Errorf("invalid event")
+	}
+	n, err := queryInt(q, "numwant", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// We use the address the request came from, rather than trusting the ip
+	// parameter, so peers can't direct others at third parties.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	a.IP = net.ParseIP(host)
+	if ip4 := a.IP.To4(); ip4 != nil {
+		a.IP = ip4
+	}
+
+	peers, complete, incomplete := s.Store.Announce(a, numWant(int(n)))
+	res := map[string]interface{}{
+		"complete":   complete,
+		"incomplete": incomplete,
+		"interval":   int(s.interval() / time.Second),
+	}
+	if s.MinInterval != 0 {
+		res["min interval"] = int(s.MinInterval / time.Second)
+	}
+
+	if q.Get("compact") == "1" {
+		var peers4, peers6 []byte
+		for _, p := range peers {
+			if ip4 := p.IPAddress.To4(); ip4 != nil {
+				peers4 = append(append(peers4, ip4...), byte(p.Port>>8), byte(p.Port))
+			} else {
+				peers6 = append(append(peers6, p.IPAddress.To16()...), byte(p.Port>>8), byte(p.Port))
+			}
+		}
+		res["peers"] = append([]byte{}, peers4...)
+		if peers6 != nil {
+			res["peers6"] = peers6
+		}
+	} else {
+		list := []interface{}{}
+		for _, p := range peers {
+			d := map[string]interface{}{
+				"ip":   p.IPAddress.String(),
+				"port": p.Port,
+			}
+			if q.Get("no_peer_id") != "1" {
+				d["peer id"] = p.ID
+			}
+			list = append(list, d)
+		}
+		res["peers"] = list
+	}
+	return res, nil
+}
+
+func (s *Server) scrape(r *http.Request) (interface{}, error) {
+	var hashes [][20]byte
+	for _, v := range r.URL.Query()["info_hash"] {
+		h, err := queryHash(v, "info_hash")
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	// With no info hashes, we report on everything
+	if hashes == nil {
+		for _, h := range s.Store.InfoHashes() {
+			if s.allowed(h) {
+				hashes = append(hashes, h)
+			}
+		}
+	}
+
+	files := make(map[string]interface{})
+	for _, h := range hashes {
+		stats, ok := s.Store.Scrape(h)
+		if !ok || !s.allowed(h) {
+			continue
+		}
+		files[string(h[:])] = map[string]int{
+			"complete":   stats.Complete,
+			"downloaded": stats.Downloaded,
+			"incomplete": stats.Incomplete,
+		}
+	}
+	return map[string]interface{}{"files": files}, nil
+}
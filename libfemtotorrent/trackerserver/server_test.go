@@ -0,0 +1,194 @@
+package trackerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/bencoding"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+func newID(t *testing.T) peer.ID {
+	id, err := peer.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestServerAnnounce(t *testing.T) {
+	srv := httptest.NewServer(&Server{Store: NewMemoryStore(time.Hour), Interval: time.Minute})
+	defer srv.Close()
+	announceURL := srv.URL + "/announce"
+	tf := torrentfile.TorrentFile{InfoHash: [20]byte{1}}
+	ctx := context.Background()
+
+	seeder := tracker.Request{Event: tracker.EventStarted, PeerID: newID(t), Port: 1000}
+	res, err := tracker.DefaultClient.Announce(ctx, announceURL, tf, seeder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 0 || res.Complete != 1 || res.Incomplete != 0 || res.Interval != time.Minute {
+		t.Errorf("first announce == %+v", res)
+	}
+
+	leecher := tracker.Request{Event: tracker.EventStarted, Stats: tracker.Stats{Left: 100}, PeerID: newID(t), Port: 2000}
+	res, err = tracker.DefaultClient.Announce(ctx, announceURL, tf, leecher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].Port != 1000 || !res.Peers[0].IPAddress.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("second announce returned peers %v", res.Peers)
+	}
+	if res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("second announce == %+v", res)
+	}
+
+	// Seeders aren't sent other seeders, but are sent leechers
+	seeder.Event = tracker.EventNone
+	res, err = tracker.DefaultClient.Announce(ctx, announceURL, tf, seeder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].Port != 2000 {
+		t.Errorf("seeder's announce returned peers %v", res.Peers)
+	}
+
+	leecher.Event = tracker.EventStopped
+	if _, err := tracker.DefaultClient.Announce(ctx, announceURL, tf, leecher); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := tracker.Scrape(ctx, announceURL, [][20]byte{tf.InfoHash, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[tf.InfoHash] != (tracker.ScrapeStats{Complete: 1}) {
+		t.Errorf("Scrape == %v", stats)
+	}
+}
+
+func TestServerNonCompact(t *testing.T) {
+	srv := httptest.NewServer(&Server{Store: NewMemoryStore(time.Hour)})
+	defer srv.Close()
+	id := newID(t)
+	query := "info_hash=aaaaaaaaaaaaaaaaaaaa&port=1000&peer_id="
+	get := func(peerID string) map[string]interface{} {
+		res, err := http.Get(srv.URL + "/announce?" + query + peerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := bencoding.Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.(map[string]interface{})
+	}
+	get(url.QueryEscape(string(id[:])) + "&left=0")
+	res := get("bbbbbbbbbbbbbbbbbbbb&left=10")
+	peers, ok := res["peers"].([]interface{})
+	if !ok || len(peers) != 1 {
+		t.Fatalf("non-compact announce returned %v", res)
+	}
+	p := peers[0].(map[string]interface{})
+	if string(p["ip"].([]byte)) != "127.0.0.1" || p["port"] != int64(1000) || string(p["peer id"].([]byte)) != string(id[:]) {
+		t.Errorf("non-compact announce returned peer %v", p)
+	}
+}
+
+func TestServerAllowed(t *testing.T) {
+	allowed := [20]byte{1}
+	srv := httptest.NewServer(&Server{Store: NewMemoryStore(time.Hour), Allowed: map[[20]byte]bool{allowed: true}})
+	defer srv.Close()
+
+	req := tracker.Request{PeerID: newID(t), Port: 1000}
+	_, err := tracker.DefaultClient.Announce(context.Background(), srv.URL+"/announce", torrentfile.TorrentFile{InfoHash: [20]byte{2}}, req)
+	var ferr *tracker.FailureError
+	if !errors.As(err, &ferr) {
+		t.Errorf("announce of unlisted torrent returned error %v", err)
+	}
+	_, err = tracker.DefaultClient.Announce(context.Background(), srv.URL+"/announce", torrentfile.TorrentFile{InfoHash: allowed}, req)
+	if err != nil {
+		t.Errorf("announce of listed torrent returned error %v", err)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	s := NewMemoryStore(10 * time.Millisecond)
+	a := Announce{InfoHash: [20]byte{1}, IP: net.IP{10, 0, 0, 1}}
+	a.PeerID = peer.ID{1}
+	a.Left = 10
+	s.Announce(a, 50)
+	time.Sleep(20 * time.Millisecond)
+	a.PeerID = peer.ID{2}
+	if peers, _, incomplete := s.Announce(a, 50); len(peers) != 0 || incomplete != 1 {
+		t.Errorf("Announce == %v, %v leechers; want the first peer expired", peers, incomplete)
+	}
+}
+
+func TestMemoryStoreForgetsSwarms(t *testing.T) {
+	s := NewMemoryStore(10 * time.Millisecond)
+	a := Announce{InfoHash: [20]byte{1}, IP: net.IP{10, 0, 0, 1}}
+	a.PeerID = peer.ID{1}
+	a.Event = tracker.EventStopped
+	s.Announce(a, 50)
+	if hashes := s.InfoHashes(); len(hashes) != 0 {
+		t.Errorf("InfoHashes() == %x after only a stopped announce", hashes)
+	}
+
+	a.Event = tracker.EventStarted
+	s.Announce(a, 50)
+	a.Event = tracker.EventStopped
+	s.Announce(a, 50)
+	if hashes := s.InfoHashes(); len(hashes) != 0 {
+		t.Errorf("InfoHashes() == %x after its only peer stopped", hashes)
+	}
+
+	// Swarms nobody announces to again are swept up
+	a.Event = tracker.EventStarted
+	s.Announce(a, 50)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := s.Scrape(a.InfoHash); ok {
+		t.Errorf("swarm still known after its only peer timed out")
+	}
+}
+
+func TestMemoryStoreSameFamily(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+	a := Announce{InfoHash: [20]byte{1}}
+	a.Left = 10
+	for i := byte(1); i <= 10; i++ {
+		a.IP = net.ParseIP(fmt.Sprintf("2001:db8::%d", i))
+		a.PeerID = peer.ID{i}
+		s.Announce(a, 50)
+	}
+	a.IP = net.IP{10, 0, 0, 1}
+	a.PeerID = peer.ID{11}
+	s.Announce(a, 50)
+
+	// Peers of the wrong family are left out before the list is trimmed,
+	// so the one IPv4 peer is always found
+	a.IP = net.IP{10, 0, 0, 2}
+	a.PeerID = peer.ID{12}
+	a.SameFamily = true
+	for i := 0; i < 10; i++ {
+		peers, _, _ := s.Announce(a, 1)
+		if len(peers) != 1 || !peers[0].IPAddress.Equal(net.IP{10, 0, 0, 1}) {
+			t.Fatalf("Announce returned peers %v, want 10.0.0.1", peers)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package trackerserver
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+// An Announce is a peer's announce, as received by a tracker.
+type Announce struct {
+	InfoHash [20]byte
+
+	// IP is the address the announce came from, and the one handed out to
+	// other peers.
+	IP net.IP
+
+	// SameFamily restricts the peers returned to those whose addresses are
+	// in the same family as IP, for clients that can only be sent one.
+	SameFamily bool
+
+	tracker.Request
+}
+
+// A Store holds the state of the swarms a tracker knows about. It's shared by
+// the HTTP and UDP servers, so must be safe for concurrent use.
+type Store interface {
+	// Announce records the announcing peer, or forgets it if it's stopping,
+	// and returns up to numWant other peers in the swarm, along with the
+	// number of seeders and leechers.
+	Announce(a Announce, numWant int) (peers []peer.Peer, complete, incomplete int)
+
+	// Scrape returns statistics about the swarm for infoHash, and false if
+	// the torrent is unknown.
+	Scrape(infoHash [20]byte) (tracker.ScrapeStats, bool)
+
+	// InfoHashes lists every torrent the Store knows about.
+	InfoHashes() [][20]byte
+}
+
+// A MemoryStore is a Store that keeps everything in memory. A swarm is
+// forgotten, download count and all, once its last peer stops or times out,
+// so announces for made-up info hashes can't use up memory.
+type MemoryStore struct {
+	// PeerTimeout is how long a peer is remembered after its last announce.
+	PeerTimeout time.Duration
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	lastSweep time.Time // When every swarm was last expired
+}
+
+type swarm struct {
+	peers      map[peer.ID]*storedPeer
+	downloaded int // Number of completed events seen
+}
+
+type storedPeer struct {
+	peer.Peer
+	left     int64
+	lastSeen time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore that forgets peers that haven't
+// announced for peerTimeout.
+func NewMemoryStore(peerTimeout time.Duration) *MemoryStore {
+	return &MemoryStore{
+		PeerTimeout: peerTimeout,
+		swarms:      make(map[[20]byte]*swarm),
+	}
+}
+
+// expire forgets peers that haven't been seen for too long. s.mu must be held.
+func (s *MemoryStore) expire(sw *swarm, now time.Time) {
+	for id, p := range sw.peers {
+		if now.Sub(p.lastSeen) > s.PeerTimeout {
+			delete(sw.peers, id)
+		}
+	}
+}
+
+// sweep expires peers from every swarm, at most once per PeerTimeout, and
+// forgets swarms left empty. Otherwise swarms nobody announces to would stay
+// around forever. s.mu must be held.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.PeerTimeout {
+		return
+	}
+	s.lastSweep = now
+	for h, sw := range s.swarms {
+		s.expire(sw, now)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, h)
+		}
+	}
+}
+
+func (sw *swarm) counts() (complete, incomplete int) {
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return
+}
+
+func (s *MemoryStore) Announce(a Announce, numWant int) (peers []peer.Peer, complete, incomplete int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	sw, ok := s.swarms[a.InfoHash]
+	if !ok {
+		if a.Event == tracker.EventStopped {
+			return nil, 0, 0
+		}
+		sw = &swarm{peers: make(map[peer.ID]*storedPeer)}
+		s.swarms[a.InfoHash] = sw
+	}
+	s.expire(sw, now)
+
+	if a.Event == tracker.EventStopped {
+		delete(sw.peers, a.PeerID)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, a.InfoHash)
+			return nil, 0, 0
+		}
+	} else {
+		sw.peers[a.PeerID] = &storedPeer{
+			Peer: peer.Peer{
+				IPAddress: a.IP,
+				Port:      a.Port,
+				ID:        append([]byte(nil), a.PeerID[:]...),
+			},
+			left:     a.Left,
+			lastSeen: now,
+		}
+	}
+	if a.Event == tracker.EventCompleted {
+		sw.downloaded++
+	}
+
+	complete, incomplete = sw.counts()
+	for id, p := range sw.peers {
+		if id == a.PeerID {
+			continue
+		}
+		// Seeders have no use for other seeders
+		if a.Left == 0 && p.left == 0 {
+			continue
+		}
+		if a.SameFamily && (a.IP.To4() == nil) != (p.IPAddress.To4() == nil) {
+			continue
+		}
+		peers = append(peers, p.Peer)
+	}
+	// Map iteration order isn't random enough to rely on
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+	return peers, complete, incomplete
+}
+
+func (s *MemoryStore) Scrape(infoHash [20]byte) (tracker.ScrapeStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(time.Now())
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return tracker.ScrapeStats{}, false
+	}
+	s.expire(sw, time.Now())
+	complete, incomplete := sw.counts()
+	return tracker.ScrapeStats{Complete: complete, Downloaded: sw.downloaded, Incomplete: incomplete}, true
+}
+
+func (s *MemoryStore) InfoHashes() [][20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(time.Now())
+	hashes := make([][20]byte, 0, len(s.swarms))
+	for h := range s.swarms {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
@@ -0,0 +1,203 @@
+package trackerserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/internal/udptracker"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+// The secret connection IDs are derived from changes this often. IDs from the
+// current and previous periods are accepted, so each is valid for between one
+// and two periods; clients are only allowed to use them for one.
+const secretRotation = time.Minute
+
+// A UDPServer is a tracker speaking the UDP tracker protocol of BEP 15
+// (http://bittorrent.org/beps/bep_0015.html).
+//
+// Connection IDs are an HMAC of the client's IP address, keyed by a secret
+// that changes every minute, so they can be checked without storing them, and
+// a client can't get one for an address it can't receive packets at.
+type UDPServer struct {
+	// Store holds the swarms. It must be set, and may be shared with a
+	// Server.
+	Store Store
+
+	// Interval is how often clients are asked to announce.
+	Interval time.Duration
+
+	// Allowed, if not nil, restricts the tracker to the torrents with these
+	// info hashes.
+	Allowed map[[20]byte]bool
+
+	keyOnce sync.Once
+	key     [32]byte
+	keyErr  error
+
+	// now is time.Now, but swapped out in tests
+	now func() time.Time
+}
+
+func (s *UDPServer) interval() time.Duration {
+	if s.Interval == 0 {
+		return DefaultInterval
+	}
+	return s.Interval
+}
+
+func (s *UDPServer) allowed(infoHash [20]byte) bool {
+	return s.Allowed == nil || s.Allowed[infoHash]
+}
+
+func (s *UDPServer) epoch() int64 {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	return now().UnixNano() / int64(secretRotation)
+}
+
+// connectionID returns the connection ID for ip during the given rotation
+// period.
+func (s *UDPServer) connectionID(ip net.IP, epoch int64) uint64 {
+	var e [8]byte
+	binary.BigEndian.PutUint64(e[:], uint64(epoch))
+	secret := hmac.New(sha256.New, s.key[:])
+	secret.Write(e[:])
+
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write(ip.To16())
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (s *UDPServer) validConnectionID(ip net.IP, id uint64) bool {
+	epoch := s.epoch()
+	return id == s.connectionID(ip, epoch) || id == s.connectionID(ip, epoch-1)
+}
+
+// Serve answers requests arriving on conn until it's closed, when it returns
+// the error from reading.
+func (s *UDPServer) Serve(conn net.PacketConn) error {
+	s.keyOnce.Do(func() { _, s.keyErr = rand.Read(s.key[:]) })
+	if s.keyErr != nil {
+		return s.keyErr
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if res := s.handle(buf[:n], udpAddr.IP); res != nil {
+			conn.WriteTo(res, addr)
+		}
+	}
+}
+
+// handle returns the response to req, sent from ip, or nil if it should be
+// ignored.
+func (s *UDPServer) handle(req []byte, ip net.IP) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	tid := req[12:16]
+
+	res := make([]byte, 8, 20)
+	binary.BigEndian.PutUint32(res[0:4], action)
+	copy(res[4:8], tid)
+	fail := func(message string) []byte {
+		binary.BigEndian.PutUint32(res[0:4], udptracker.ActionError)
+		return append(res, message...)
+	}
+
+	if action == udptracker.ActionConnect {
+		if connID != udptracker.ProtocolID {
+			return nil
+		}
+		return udptracker.AppendUint64(res, s.connectionID(ip, s.epoch()))
+	}
+	if !s.validConnectionID(ip, connID) {
+		return fail("invalid connection id")
+	}
+
+	switch action {
+	case udptracker.ActionAnnounce:
+		if len(req) < 98 {
+			return fail("announce too short")
+		}
+		var a Announce
+		copy(a.InfoHash[:], req[16:36])
+		if !s.allowed(a.InfoHash) {
+			return fail("torrent not allowed on this tracker")
+		}
+		copy(a.PeerID[:], req[36:56])
+		a.Downloaded = int64(binary.BigEndian.Uint64(req[56:64]))
+		a.Left = int64(binary.BigEndian.Uint64(req[64:72]))
+		a.Uploaded = int64(binary.BigEndian.Uint64(req[72:80]))
+		a.Event = tracker.Event(binary.BigEndian.Uint32(req[80:84]))
+		if a.Event > tracker.EventStopped {
+			return fail("invalid event")
+		}
+		// The IP address field is ignored, as with the HTTP server: peers
+		// are handed out at the address they announced from
+		a.IP = ip
+		if ip4 := ip.To4(); ip4 != nil {
+			a.IP = ip4
+		}
+		a.SameFamily = true
+		a.Key = binary.BigEndian.Uint32(req[88:92])
+		a.Port = binary.BigEndian.Uint16(req[96:98])
+
+		peers, complete, incomplete := s.Store.Announce(a, numWant(int(int32(binary.BigEndian.Uint32(req[92:96])))))
+		res = udptracker.AppendUint32(res, uint32(s.interval()/time.Second))
+		res = udptracker.AppendUint32(res, uint32(incomplete))
+		res = udptracker.AppendUint32(res, uint32(complete))
+		// Peers are sent in the address family of the request
+		for _, p := range peers {
+			ip := p.IPAddress.To4()
+			if a.IP.To4() == nil {
+				if ip != nil {
+					continue
+				}
+				ip = p.IPAddress.To16()
+			} else if ip == nil {
+				continue
+			}
+			res = append(res, ip...)
+			res = append(res, byte(p.Port>>8), byte(p.Port))
+		}
+		return res
+
+	case udptracker.ActionScrape:
+		hashes := req[16:]
+		if len(hashes)%20 != 0 || len(hashes) > 20*udptracker.MaxScrape {
+			return fail("invalid scrape")
+		}
+		for i := 0; i < len(hashes); i += 20 {
+			var h [20]byte
+			copy(h[:], hashes[i:i+20])
+			var stats tracker.ScrapeStats
+			if s.allowed(h) {
+				stats, _ = s.Store.Scrape(h)
+			}
+			res = udptracker.AppendUint32(res, uint32(stats.Complete))
+			res = udptracker.AppendUint32(res, uint32(stats.Downloaded))
+			res = udptracker.AppendUint32(res, uint32(stats.Incomplete))
+		}
+		return res
+	}
+	return fail("unknown action")
+}
@@ -0,0 +1,128 @@
+package trackerserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/internal/udptracker"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+func serveUDP(t *testing.T, s *UDPServer, network, addr string) string {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("can't listen on %v: %v", addr, err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestUDPServer(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	addr := serveUDP(t, &UDPServer{Store: store, Interval: time.Minute}, "udp", "127.0.0.1:0")
+	client := &tracker.UDPClient{BaseTimeout: 100 * time.Millisecond, MaxRetries: 2}
+	ctx := context.Background()
+	tf := torrentfile.TorrentFile{InfoHash: [20]byte{1}}
+
+	seeder := tracker.Request{Event: tracker.EventStarted, PeerID: newID(t), Port: 1000}
+	if _, err := client.Announce(ctx, addr, tf, seeder); err != nil {
+		t.Fatal(err)
+	}
+	leecher := tracker.Request{Event: tracker.EventStarted, Stats: tracker.Stats{Left: 10}, PeerID: newID(t), Port: 2000}
+	res, err := client.Announce(ctx, addr, tf, leecher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].Port != 1000 || res.Complete != 1 || res.Incomplete != 1 || res.Interval != time.Minute {
+		t.Errorf("Announce == %+v", res)
+	}
+
+	seeder.Event = tracker.EventCompleted
+	if _, err := client.Announce(ctx, addr, tf, seeder); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := client.Scrape(ctx, addr, [][20]byte{tf.InfoHash, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tracker.ScrapeStats{{Complete: 1, Downloaded: 1, Incomplete: 1}, {}}
+	if len(stats) != 2 || stats[0] != want[0] || stats[1] != want[1] {
+		t.Errorf("Scrape == %v, want %v", stats, want)
+	}
+
+	// The HTTP server sharing the store should see the same swarm
+	if s, ok := store.Scrape(tf.InfoHash); !ok || s != want[0] {
+		t.Errorf("store.Scrape == %v, %v", s, ok)
+	}
+}
+
+func TestUDPServerIPv6(t *testing.T) {
+	addr := serveUDP(t, &UDPServer{Store: NewMemoryStore(time.Hour)}, "udp6", "[::1]:0")
+	client := &tracker.UDPClient{BaseTimeout: 100 * time.Millisecond, MaxRetries: 2}
+	tf := torrentfile.TorrentFile{InfoHash: [20]byte{1}}
+	for _, port := range []uint16{1000, 2000} {
+		res, err := client.Announce(context.Background(), addr, tf, tracker.Request{PeerID: newID(t), Port: port, Stats: tracker.Stats{Left: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port == 2000 && (len(res.Peers) != 1 || !res.Peers[0].IPAddress.Equal(net.IPv6loopback) || res.Peers[0].Port != 1000) {
+			t.Errorf("Announce returned peers %v", res.Peers)
+		}
+	}
+}
+
+func TestUDPServerAllowed(t *testing.T) {
+	addr := serveUDP(t, &UDPServer{Store: NewMemoryStore(time.Hour), Allowed: map[[20]byte]bool{{1}: true}}, "udp", "127.0.0.1:0")
+	client := &tracker.UDPClient{BaseTimeout: 100 * time.Millisecond, MaxRetries: 2}
+	_, err := client.Announce(context.Background(), addr, torrentfile.TorrentFile{InfoHash: [20]byte{2}}, tracker.Request{})
+	var ferr *tracker.FailureError
+	if !errors.As(err, &ferr) {
+		t.Errorf("Announce of unlisted torrent returned error %v", err)
+	}
+}
+
+func TestUDPServerConnectionIDs(t *testing.T) {
+	now := time.Unix(60*16666, 0)
+	s := &UDPServer{Store: NewMemoryStore(time.Hour), now: func() time.Time { return now }}
+	s.key[0] = 1
+	ip := net.IPv4(10, 0, 0, 1)
+
+	connect := make([]byte, 16)
+	binary.BigEndian.PutUint64(connect[0:8], udptracker.ProtocolID)
+	res := s.handle(connect, ip)
+	if len(res) != 16 {
+		t.Fatalf("connect response %x", res)
+	}
+	id := binary.BigEndian.Uint64(res[8:16])
+
+	cases := []struct {
+		ip    net.IP
+		after time.Duration
+		valid bool
+	}{
+		{ip, 0, true},
+		{ip, 119 * time.Second, true},
+		{ip, 121 * time.Second, false},
+		{net.IPv4(10, 0, 0, 2), 0, false},
+	}
+	for _, c := range cases {
+		now = time.Unix(60*16666, 0).Add(c.after)
+		if got := s.validConnectionID(c.ip, id); got != c.valid {
+			t.Errorf("connection id from %v valid %v later == %v, want %v", c.ip, c.after, got, c.valid)
+		}
+	}
+
+	// Scrapes with a bad connection ID get an error
+	scrape := make([]byte, 36)
+	binary.BigEndian.PutUint64(scrape[0:8], id+1)
+	binary.BigEndian.PutUint32(scrape[8:12], udptracker.ActionScrape)
+	if res := s.handle(scrape, ip); len(res) < 8 || binary.BigEndian.Uint32(res[0:4]) != udptracker.ActionError {
+		t.Errorf("scrape with invalid connection id returned %x", res)
+	}
+}
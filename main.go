@@ -1,52 +1,51 @@
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"net"
+	"fmt"
 	"os"
-
-	"github.com/chandlerswift/femtotorrent/libfemtotorrent/peer"
-	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
-	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+	"sort"
 )
 
-func main() {
-	file, err := os.Open("debian-11.2.0-amd64-netinst.iso.torrent")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
+// A command is a femtotorrent subcommand, run with the arguments following
+// its name.
+type command struct {
+	run   func(args []string) error
+	usage string
+}
 
-	b, err := ioutil.ReadAll(file)
+var commands = map[string]command{
+	"download": {download, "download [-picker rarest|sequential] [-lazy-bitfield] [file.torrent]"},
+	"bdump":    {bdump, "bdump [flags] [file]"},
+	"scrape":   {scrape, "scrape file.torrent..."},
+	"tracker":  {runTracker, "tracker [-addr :6969] [-udp :6969] [-interval 30m] [file.torrent...]"},
+}
 
-	tf, err := torrentfile.DecodeTorrentFile(b)
-	if err != nil {
-		panic(err)
-	}
-	peers, interval, err := tracker.GetPeers(tf)
-	if err != nil {
-		panic(err)
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: femtotorrent <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
 	}
-	log.Println(peers, interval)
-	for _, peer := range peers {
-		log.Printf("%v:%d", string(peer.IPAddress), peer.Port)
-	}
-	localPeer := peer.Peer{
-		IPAddress: net.ParseIP("127.0.0.1"),
-		Port:      51413,
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  femtotorrent %v\n", commands[name].usage)
 	}
+	os.Exit(2)
+}
 
-	log.Printf("Writing to %v", tf.Info.Name)
-	f, err := os.OpenFile(tf.Info.Name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		panic(err)
+func main() {
+	// With no command, we download, as we always have
+	name, args := "download", os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
-	defer f.Close()
-
-	err = localPeer.Handle(tf, f)
-	if err != nil {
-		panic(err)
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "femtotorrent %v: %v\n", name, err)
+		os.Exit(1)
 	}
-
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/tracker"
+)
+
+// How long to give each tracker to respond
+const scrapeTimeout = time.Minute
+
+// scrape prints swarm statistics for each of the given torrents, from each
+// of their trackers. Torrents sharing a tracker are scraped together.
+func scrape(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected at least one torrent file")
+	}
+
+	var torrents []torrentfile.TorrentFile
+	var trackers []string // In the order first seen, for stable output
+	hashes := make(map[string][][20]byte)
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		tf, err := torrentfile.ReadTorrentFile(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		torrents = append(torrents, tf)
+		for _, tier := range tf.Tiers() {
+			for _, trackerURL := range tier {
+				if hashes[trackerURL] == nil {
+					trackers = append(trackers, trackerURL)
+				}
+				hashes[trackerURL] = append(hashes[trackerURL], tf.InfoHash)
+			}
+		}
+	}
+
+	results := make(map[string]map[[20]byte]tracker.ScrapeStats)
+	for _, trackerURL := range trackers {
+		ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+		stats, err := tracker.Scrape(ctx, trackerURL, hashes[trackerURL])
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", trackerURL, err)
+			continue
+		}
+		results[trackerURL] = stats
+	}
+
+	for _, tf := range torrents {
+		fmt.Printf("%v %v\n", hex.EncodeToString(tf.InfoHash[:]), tf.Info.Name)
+		for _, tier := range tf.Tiers() {
+			for _, trackerURL := range tier {
+				stats, ok := results[trackerURL][tf.InfoHash]
+				if !ok {
+					continue
+				}
+				fmt.Printf("  %v: %v seeders, %v leechers, %v downloads\n", trackerURL, stats.Complete, stats.Incomplete, stats.Downloaded)
+			}
+		}
+	}
+	return nil
+}
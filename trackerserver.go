@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/torrentfile"
+	"github.com/chandlerswift/femtotorrent/libfemtotorrent/trackerserver"
+)
+
+// runTracker serves a tracker. If any torrent files are given, only those
+// torrents are tracked.
+func runTracker(args []string) error {
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := flags.String("addr", ":6969", "address to serve HTTP on")
+	udpAddr := flags.String("udp", "", "address to serve UDP on, if any")
+	interval := flags.Duration("interval", trackerserver.DefaultInterval, "how often clients should announce")
+	flags.Parse(args)
+
+	// Peers get a couple of chances to announce before they're forgotten
+	store := trackerserver.NewMemoryStore(2 * *interval)
+	srv := &trackerserver.Server{Store: store, Interval: *interval}
+
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		tf, err := torrentfile.ReadTorrentFile(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		if srv.Allowed == nil {
+			srv.Allowed = make(map[[20]byte]bool)
+		}
+		srv.Allowed[tf.InfoHash] = true
+		log.Printf("Tracking %x %v", tf.InfoHash, tf.Info.Name)
+	}
+
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		udp := &trackerserver.UDPServer{Store: store, Interval: *interval, Allowed: srv.Allowed}
+		log.Printf("Serving UDP tracker on %v", conn.LocalAddr())
+		go func() {
+			log.Printf("UDP tracker stopped: %v", udp.Serve(conn))
+		}()
+	}
+
+	log.Printf("Serving HTTP tracker on %v", *addr)
+	server := &http.Server{
+		Addr:         *addr,
+		Handler:      srv,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return server.ListenAndServe()
+}